@@ -126,6 +126,16 @@ func (f *File) WriteString(s string) (n int, err error) {
 	return n, f.handleError(err)
 }
 
+// Chmod changes the mode of the file. Temporary file is created
+// with mode 0600, use it if the destination file should be e.g. 0644
+func (f *File) Chmod(mode os.FileMode) error {
+	if f.err != nil {
+		return f.err
+	}
+	err := f.tmpFile.Chmod(mode)
+	return f.handleError(err)
+}
+
 func (f *File) alreadyClosed() bool {
 	return f.tmpFile == nil
 }
@@ -1,6 +1,7 @@
 package filerotate
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -9,9 +10,25 @@ import (
 	"time"
 )
 
+var (
+	// ErrWriteTooLarge is returned by Write when data is larger than Config.MaxWriteSize
+	ErrWriteTooLarge = errors.New("write larger than MaxWriteSize")
+	// ErrFileClosed is returned by Write, Write2 and Sync after Close
+	ErrFileClosed = errors.New("file already closed")
+)
+
 type Config struct {
 	DidClose           func(path string, didRotate bool)
 	PathIfShouldRotate func(creationTime time.Time, now time.Time) string
+	// if > 0, writes larger than this fail with ErrWriteTooLarge
+	// and nothing is written
+	MaxWriteSize int
+	// if set (e.g. "current.txt"), after opening a file we create a symlink
+	// with this name, in the same directory, pointing to the current file.
+	// Where symlinks can't be created (e.g. Windows without privileges),
+	// we write a file containing path of the current file.
+	// It's best-effort: failing to create it doesn't fail writes
+	CurrentSymlink string
 }
 
 type File struct {
@@ -26,6 +43,8 @@ type File struct {
 
 	config Config
 	file   *os.File
+	// set in Close(), after that all writes fail
+	closed bool
 
 	// position in the file of last Write or Write2, exposed for tests
 	lastWritePos int64
@@ -145,6 +164,43 @@ func (f *File) open(path string) error {
 		return err
 	}
 	_, err = f.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.file.Close()
+		f.file = nil
+		return err
+	}
+	if f.config.CurrentSymlink != "" {
+		// it's only a convenience so failing to create it shouldn't
+		// fail the write
+		_ = updateCurrentSymlink(f.Path, filepath.Join(dir, f.config.CurrentSymlink))
+	}
+	return nil
+}
+
+// atomically (re)create a symlink at linkPath pointing to path
+func updateCurrentSymlink(path string, linkPath string) error {
+	target, err := filepath.Rel(filepath.Dir(linkPath), path)
+	if err != nil {
+		target = path
+	}
+	tmpPath := linkPath + ".tmp"
+	_ = os.Remove(tmpPath)
+	err = os.Symlink(target, tmpPath)
+	if err == nil {
+		err = os.Rename(tmpPath, linkPath)
+		if err == nil {
+			return nil
+		}
+		_ = os.Remove(tmpPath)
+	}
+	// symlinks not supported, write a pointer file instead
+	err = os.WriteFile(tmpPath, []byte(path), 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, linkPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+	}
 	return err
 }
 
@@ -162,6 +218,12 @@ func (f *File) reopenIfNeeded() error {
 }
 
 func (f *File) write(d []byte, sync bool) (int64, int, error) {
+	if f.closed {
+		return 0, 0, ErrFileClosed
+	}
+	if f.config.MaxWriteSize > 0 && len(d) > f.config.MaxWriteSize {
+		return 0, 0, fmt.Errorf("%w: %d > %d", ErrWriteTooLarge, len(d), f.config.MaxWriteSize)
+	}
 	err := f.reopenIfNeeded()
 	if err != nil {
 		return 0, 0, err
@@ -205,6 +267,7 @@ func (f *File) Close() error {
 	f.Lock()
 	defer f.Unlock()
 
+	f.closed = true
 	return f.close(false)
 }
 
@@ -213,5 +276,8 @@ func (f *File) Sync() error {
 	f.Lock()
 	defer f.Unlock()
 
+	if f.closed {
+		return ErrFileClosed
+	}
 	return f.file.Sync()
 }
@@ -0,0 +1,143 @@
+package filerotate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/kjk/common/assert"
+)
+
+func TestMaxWriteSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.txt")
+	config := Config{
+		PathIfShouldRotate: func(creationTime time.Time, now time.Time) string {
+			if creationTime.IsZero() {
+				return path
+			}
+			return ""
+		},
+		MaxWriteSize: 4,
+	}
+	f, err := New(&config)
+	assert.NoError(t, err)
+
+	n, err := f.Write([]byte("abcd"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	n, err = f.Write([]byte("abcde"))
+	assert.True(t, errors.Is(err, ErrWriteTooLarge))
+	assert.Equal(t, 0, n)
+
+	_, _, err = f.Write2([]byte("abcde"), false)
+	assert.True(t, errors.Is(err, ErrWriteTooLarge))
+
+	err = f.Close()
+	assert.NoError(t, err)
+	d, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(d))
+}
+
+func TestCurrentSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	dir := t.TempDir()
+	n := 0
+	config := Config{
+		// rotate on every write
+		PathIfShouldRotate: func(creationTime time.Time, now time.Time) string {
+			n++
+			return filepath.Join(dir, fmt.Sprintf("log-%d.txt", n))
+		},
+		CurrentSymlink: "current.txt",
+	}
+	f, err := New(&config)
+	assert.NoError(t, err)
+	linkPath := filepath.Join(dir, "current.txt")
+	target, err := os.Readlink(linkPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "log-1.txt", target)
+
+	_, err = f.Write([]byte("hello"))
+	assert.NoError(t, err)
+	target, err = os.Readlink(linkPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "log-2.txt", target)
+	assert.Equal(t, filepath.Join(dir, target), f.Path)
+
+	err = f.Close()
+	assert.NoError(t, err)
+	d, err := os.ReadFile(linkPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(d))
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.txt")
+	config := Config{
+		PathIfShouldRotate: func(creationTime time.Time, now time.Time) string {
+			if creationTime.IsZero() {
+				return path
+			}
+			return ""
+		},
+	}
+	f, err := New(&config)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	assert.NoError(t, err)
+	err = f.Close()
+	assert.NoError(t, err)
+
+	n, err := f.Write([]byte("after close"))
+	assert.True(t, errors.Is(err, ErrFileClosed))
+	assert.Equal(t, 0, n)
+	_, _, err = f.Write2([]byte("after close"), true)
+	assert.True(t, errors.Is(err, ErrFileClosed))
+	err = f.Sync()
+	assert.True(t, errors.Is(err, ErrFileClosed))
+	// closing again is fine
+	err = f.Close()
+	assert.NoError(t, err)
+
+	d, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(d))
+}
+
+func TestCurrentSymlinkFails(t *testing.T) {
+	dir := t.TempDir()
+	// can't replace non-empty directory with a symlink or a file
+	linkPath := filepath.Join(dir, "current.txt")
+	err := os.MkdirAll(filepath.Join(linkPath, "sub"), 0755)
+	assert.NoError(t, err)
+
+	n := 0
+	config := Config{
+		// rotate on every write
+		PathIfShouldRotate: func(creationTime time.Time, now time.Time) string {
+			n++
+			return filepath.Join(dir, fmt.Sprintf("log-%d.txt", n))
+		},
+		CurrentSymlink: "current.txt",
+	}
+	f, err := New(&config)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	assert.NoError(t, err)
+	err = f.Close()
+	assert.NoError(t, err)
+
+	d, err := os.ReadFile(filepath.Join(dir, "log-2.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(d))
+	_, err = os.Lstat(linkPath + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -2,6 +2,8 @@ package httputil
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -10,13 +12,15 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/kjk/common/u"
 )
 
 // can be used for http.Get() requests with better timeouts. New one must be created
-// for each Get() request
+// for each Get() request because deadline is set once, when connection is made.
+// For a long-lived client, shared between requests, use NewReusableClient
 func NewTimeoutClient(connectTimeout time.Duration, readWriteTimeout time.Duration) *http.Client {
 	timeoutDialer := func(cTimeout time.Duration, rwTimeout time.Duration) func(net, addr string) (c net.Conn, err error) {
 		return func(netw, addr string) (net.Conn, error) {
@@ -37,10 +41,61 @@ func NewTimeoutClient(connectTimeout time.Duration, readWriteTimeout time.Durati
 	}
 }
 
+// NewReusableClient returns http.Client meant to be created once and shared
+// between many requests, so that connections are re-used.
+// timeout limits total time of a request, including reading the body
+func NewReusableClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: tr,
+		Timeout:   timeout,
+	}
+}
+
 func NewDefaultTimeoutClient() *http.Client {
 	return NewTimeoutClient(time.Second*120, time.Second*120)
 }
 
+// bodyReader returns resp.Body, decompressed based on Content-Encoding.
+// http.Transport only decompresses gzip if it asked for it, some
+// servers send compressed body anyway.
+// For unknown encodings we sniff the data and, if it's not in
+// a known compressed format, return it as is.
+// Caller must close returned reader
+func bodyReader(resp *http.Response) (io.ReadCloser, error) {
+	err := u.DecompressResponseBody(resp)
+	if errors.Is(err, u.ErrUnsupportedEncoding) {
+		return u.NewDecompressingReader(resp.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func readBody(resp *http.Response) ([]byte, error) {
+	r, err := bodyReader(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
 func Get(uri string) ([]byte, error) {
 	c := NewDefaultTimeoutClient()
 	resp, err := c.Get(uri)
@@ -51,7 +106,7 @@ func Get(uri string) ([]byte, error) {
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("'%s': status code not 200 (%d)", uri, resp.StatusCode)
 	}
-	return io.ReadAll(resp.Body)
+	return readBody(resp)
 }
 
 func GetToFile(uri string, f *os.File) error {
@@ -64,7 +119,12 @@ func GetToFile(uri string, f *os.File) error {
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("'%s': status code not 200 (%d)", uri, resp.StatusCode)
 	}
-	_, err = io.Copy(f, resp.Body)
+	r, err := bodyReader(resp)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(f, r)
 	return err
 }
 
@@ -78,7 +138,7 @@ func Post(uri string, body []byte) ([]byte, error) {
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("'%s': status code not 200 (%d)", uri, resp.StatusCode)
 	}
-	return io.ReadAll(resp.Body)
+	return readBody(resp)
 }
 
 func createMultiPartForm(form map[string]string) (string, io.Reader, error) {
@@ -121,7 +181,7 @@ func PostMultiPart(uri string, files map[string]string) ([]byte, error) {
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("'%s': status code not 200 (%d)", uri, resp.StatusCode)
 	}
-	return io.ReadAll(resp.Body)
+	return readBody(resp)
 }
 
 func JoinURL(s1, s2 string) string {
@@ -176,6 +236,74 @@ func GetBestRemoteAddress(r *http.Request) string {
 	return ""
 }
 
+func isLocalIP(s string) bool {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate()
+}
+
+// IsLocalRequest returns true if request comes from loopback or private
+// network (RFC 1918 / RFC 4193) address. Useful for gating admin endpoints.
+// Proxy headers (X-Forwarded-For etc.) are only considered if the direct
+// connection is local. Since a client can put anything in X-Forwarded-For
+// and a proxy only appends to it, every address in them must be local.
+func IsLocalRequest(r *http.Request) bool {
+	if !isLocalIP(r.RemoteAddr) {
+		return false
+	}
+	h := r.Header
+	for _, hdr := range []string{"CF-Connecting-IP", "X-Real-Ip", "X-Forwarded-For"} {
+		// header can be repeated and values can be "ip1, ip2, ip3"
+		for _, v := range h.Values(hdr) {
+			for _, ip := range strings.Split(v, ",") {
+				if !isLocalIP(ip) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// TimeoutMiddleware returns a middleware that responds with 503 Service Unavailable
+// if handler takes longer than d (see http.TimeoutHandler).
+// onTimeout, if not nil, is called for requests that timed out e.g. to log them.
+func TimeoutMiddleware(d time.Duration, onTimeout func(r *http.Request)) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// on timeout http.TimeoutHandler returns without waiting for
+			// the handler. It also returns early if the client cancels
+			// the request, so we check if the deadline of the context
+			// given to the handler has passed
+			var finishedInTime atomic.Bool
+			var innerCtx atomic.Pointer[context.Context]
+			inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx := r.Context()
+				innerCtx.Store(&ctx)
+				h.ServeHTTP(w, r)
+				// handler might return quickly after the deadline
+				// because it watches ctx.Done()
+				if ctx.Err() != context.DeadlineExceeded {
+					finishedInTime.Store(true)
+				}
+			})
+			http.TimeoutHandler(inner, d, "").ServeHTTP(w, r)
+			if onTimeout == nil || finishedInTime.Load() {
+				return
+			}
+			if ctx := innerCtx.Load(); ctx != nil && (*ctx).Err() == context.DeadlineExceeded {
+				onTimeout(r)
+			}
+		})
+	}
+}
+
 func getHeader(h http.Header, hdrKey string, mapKey string, m map[string]interface{}) {
 	val := h.Get(hdrKey)
 	if len(val) > 0 {
@@ -1,10 +1,18 @@
 package httputil
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/kjk/common/assert"
+	"github.com/kjk/common/u"
 )
 
 func TestJoinURL(t *testing.T) {
@@ -38,3 +46,289 @@ func TestMakeFullRedirectURL(t *testing.T) {
 		assert.Equal(t, exp, got)
 	}
 }
+
+func TestCountingResponseWriter(t *testing.T) {
+	{
+		rec := httptest.NewRecorder()
+		w := NewCountingResponseWriter(rec)
+		w.Write([]byte("hello"))
+		w.Write([]byte(" world"))
+		assert.Equal(t, http.StatusOK, w.StatusCode)
+		assert.Equal(t, int64(11), w.BytesWritten)
+		assert.Equal(t, "hello world", rec.Body.String())
+		w.Flush()
+		assert.True(t, rec.Flushed)
+		_, _, err := w.Hijack()
+		assert.Error(t, err)
+	}
+	{
+		rec := httptest.NewRecorder()
+		w := NewCountingResponseWriter(rec)
+		http.NotFound(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusNotFound, w.StatusCode)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Equal(t, int64(rec.Body.Len()), w.BytesWritten)
+	}
+}
+
+func TestServeFileCacheControl(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dist/index.html":     {Data: []byte("<html></html>")},
+		"dist/static/app.js":  {Data: []byte("console.log('hi')")},
+		"dist/static/app.css": {Data: []byte("body {}")},
+	}
+	tests := []struct {
+		uri           string
+		defaultMaxAge time.Duration
+		exp           string
+	}{
+		{"/index.html", 0, ""},
+		{"/index.html", 5 * time.Minute, "public, max-age=300"},
+		{"/static/app.js", 0, "public, max-age=31536000, immutable"},
+		{"/static/app.css", 5 * time.Minute, "public, max-age=31536000, immutable"},
+	}
+	for _, test := range tests {
+		opts := &ServeFileOptions{
+			FS:                   fsys,
+			DirPrefix:            "dist/",
+			LongLivedURLPrefixes: []string{"/static/"},
+			DefaultMaxAge:        test.defaultMaxAge,
+		}
+		r := httptest.NewRequest(http.MethodGet, test.uri, nil)
+		w := httptest.NewRecorder()
+		ok := TryServeURLFromFS(w, r, opts)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, test.exp, w.Header().Get("Cache-Control"), "uri: %s", test.uri)
+	}
+}
+
+func TestGetDecompresses(t *testing.T) {
+	body := []byte("hello, compressed world")
+	gzData, err := u.GzipCompressData(body)
+	assert.NoError(t, err)
+	brData, err := u.BrCompressDataDefault(body)
+	assert.NoError(t, err)
+	zstdData, err := u.ZstdCompressDataDefault(body)
+	assert.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzData)
+		case "/br":
+			w.Header().Set("Content-Encoding", "br")
+			w.Write(brData)
+		case "/zstd":
+			w.Header().Set("Content-Encoding", "zstd")
+			w.Write(zstdData)
+		case "/bogus":
+			// some broken servers send charset as encoding
+			w.Header().Set("Content-Encoding", "UTF-8")
+			w.Write(body)
+		case "/stacked":
+			// not supported, we sniff the data
+			w.Header().Set("Content-Encoding", "gzip, br")
+			w.Write(gzData)
+		default:
+			w.Write(body)
+		}
+	}))
+	defer srv.Close()
+
+	for _, uri := range []string{"/gzip", "/br", "/zstd", "/plain", "/bogus", "/stacked"} {
+		d, err := Get(srv.URL + uri)
+		assert.NoError(t, err)
+		assert.Equal(t, body, d, "uri: %s", uri)
+	}
+}
+
+func TestIsLocalRequest(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		exp        bool
+	}{
+		{"127.0.0.1:5432", "", true},
+		{"[::1]:5432", "", true},
+		{"10.0.0.5:80", "", true},
+		{"172.16.3.4:80", "", true},
+		{"192.168.1.10:80", "", true},
+		{"172.32.0.1:80", "", false},
+		{"8.8.8.8:80", "", false},
+		{"[2001:4860::8888]:80", "", false},
+		{"bogus", "", false},
+		// behind local proxy
+		{"127.0.0.1:5432", "192.168.1.10", true},
+		{"127.0.0.1:5432", "8.8.8.8", false},
+		{"127.0.0.1:5432", "8.8.8.8, 127.0.0.1", false},
+		// leftmost value is set by the client, proxy appends the real one
+		{"127.0.0.1:5432", "10.1.1.1, 8.8.8.8", false},
+		{"127.0.0.1:5432", "10.1.1.1, 192.168.1.10", true},
+		{"127.0.0.1:5432", "10.1.1.1,", false},
+		// remote client can't spoof X-Forwarded-For
+		{"8.8.8.8:80", "127.0.0.1", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		got := IsLocalRequest(r)
+		assert.Equal(t, test.exp, got, "remoteAddr: %s, xff: %s", test.remoteAddr, test.xff)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	var timedOut []string
+	onTimeout := func(r *http.Request) {
+		timedOut = append(timedOut, r.URL.Path)
+	}
+	mw := TimeoutMiddleware(20*time.Millisecond, onTimeout)
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	{
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fast", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "ok", w.Body.String())
+		assert.Equal(t, 0, len(timedOut))
+	}
+	{
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, []string{"/slow"}, timedOut)
+	}
+}
+
+func TestTimeoutMiddlewareClientCancel(t *testing.T) {
+	var timedOut atomic.Bool
+	onTimeout := func(r *http.Request) {
+		timedOut.Store(true)
+	}
+	mw := TimeoutMiddleware(time.Second, onTimeout)
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+	}()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	// client went away, it's not a timeout
+	assert.False(t, timedOut.Load())
+}
+
+func TestNewReusableClient(t *testing.T) {
+	var remoteAddrs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs = append(remoteAddrs, r.RemoteAddr)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	c := NewReusableClient(10 * time.Second)
+	assert.Equal(t, 10*time.Second, c.Timeout)
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(srv.URL)
+		assert.NoError(t, err)
+		d, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "ok", string(d))
+	}
+	// connection was re-used
+	assert.Equal(t, 3, len(remoteAddrs))
+	assert.Equal(t, remoteAddrs[0], remoteAddrs[2])
+}
+
+func TestBestEncoding(t *testing.T) {
+	supported := []string{"br", "gzip"}
+	tests := []struct {
+		acceptEncoding string
+		exp            string
+	}{
+		{"", "identity"},
+		{"gzip", "gzip"},
+		{"br", "br"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, br", "br"},
+		{"GZIP", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"br;q=0.5, gzip;q=0.8", "gzip"},
+		{"br;q=0.8, gzip;q=0.8", "br"},
+		{"br ; q=0.1, gzip ; q=0.2", "gzip"},
+		{"deflate", "identity"},
+		{"*", "br"},
+		{"*;q=0.5, br;q=0.1", "gzip"},
+		{"gzip;q=0, br;q=0", "identity"},
+		{"br;q=invalid", "br"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		got := BestEncoding(r, supported)
+		assert.Equal(t, tc.exp, got, "Accept-Encoding: %s", tc.acceptEncoding)
+	}
+}
+
+func TestServeBytes(t *testing.T) {
+	data := []byte("body { color: red; }")
+	modTime := time.Date(2024, 3, 5, 10, 20, 30, 0, time.UTC)
+	serve := func(hdr http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/main.css", nil)
+		for k, v := range hdr {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		ServeBytes(w, r, "main.css", data, modTime)
+		return w
+	}
+
+	w := serve(nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+	assert.Equal(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, `"`+u.DataSha1Hex(data)+`"`, etag)
+	assert.Equal(t, modTime.Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+
+	w = serve(http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, 0, w.Body.Len())
+
+	w = serve(http.Header{"If-None-Match": {`"other"`}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+
+	w = serve(http.Header{"If-Modified-Since": {modTime.Format(http.TimeFormat)}})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = serve(http.Header{"If-Modified-Since": {modTime.Add(-time.Hour).Format(http.TimeFormat)}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// ETag set by the caller is used as is
+	r := httptest.NewRequest(http.MethodGet, "/main.css", nil)
+	r.Header.Set("If-None-Match", `"precomputed"`)
+	rec := httptest.NewRecorder()
+	rec.Header().Set("ETag", `"precomputed"`)
+	ServeBytes(rec, r, "main.css", data, modTime)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Equal(t, `"precomputed"`, rec.Header().Get("ETag"))
+}
@@ -0,0 +1,64 @@
+package httputil
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// CountingResponseWriter wraps http.ResponseWriter and records
+// status code and number of bytes written, e.g. for logging
+type CountingResponseWriter struct {
+	http.ResponseWriter
+	// StatusCode is http.StatusOK if WriteHeader() wasn't called
+	StatusCode   int
+	BytesWritten int64
+
+	wroteHeader bool
+}
+
+// NewCountingResponseWriter creates CountingResponseWriter wrapping w
+func NewCountingResponseWriter(w http.ResponseWriter) *CountingResponseWriter {
+	return &CountingResponseWriter{
+		ResponseWriter: w,
+		StatusCode:     http.StatusOK,
+	}
+}
+
+func (w *CountingResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.StatusCode = statusCode
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *CountingResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.BytesWritten += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher. It's a no-op if the underlying
+// writer doesn't support flushing
+func (w *CountingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker
+func (w *CountingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("http.Hijacker not supported by underlying http.ResponseWriter")
+}
+
+// Unwrap returns the underlying http.ResponseWriter,
+// for the benefit of http.ResponseController
+func (w *CountingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
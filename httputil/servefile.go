@@ -2,10 +2,12 @@ package httputil
 
 import (
 	"bytes"
+	"fmt"
 	"io/fs"
 	"net/http"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -26,7 +28,9 @@ type ServeFileOptions struct {
 	ServeCompressed  bool
 	// list of url prefixes that should be served as long-lived (e.g. /static/, /assets/)
 	LongLivedURLPrefixes []string
-	compressedCached     map[string][]byte
+	// if > 0, Cache-Control max-age for files that are not long-lived
+	DefaultMaxAge    time.Duration
+	compressedCached map[string]*compressedFile
 }
 
 func serveFileFromFS(w http.ResponseWriter, r *http.Request, opts *ServeFileOptions, fsPath string) bool {
@@ -34,7 +38,7 @@ func serveFileFromFS(w http.ResponseWriter, r *http.Request, opts *ServeFileOpti
 		return false
 	}
 	// at this point fsPath is a valid file in fs
-	if serveFileMaybeBr(w, r, opts, fsPath) {
+	if serveFileMaybeCompressed(w, r, opts, fsPath) {
 		return true
 	}
 	d, err := fs.ReadFile(opts.FS, fsPath)
@@ -57,6 +61,32 @@ func serveFileFromFS(w http.ResponseWriter, r *http.Request, opts *ServeFileOpti
 	return true
 }
 
+// MakeETag returns ETag header value for data (quoted sha1 of data)
+func MakeETag(data []byte) string {
+	return `"` + u.DataSha1Hex(data) + `"`
+}
+
+// ServeBytes serves data with ETag and Last-Modified headers
+// so that conditional GET requests (If-None-Match, If-Modified-Since)
+// get 304 Not Modified response. Content-Type is based on name,
+// unless already set. Also supports Range requests.
+// ETag is sha1 of data (see MakeETag), unless already set. If you serve
+// the same data many times, set it to avoid re-calculating sha1
+func ServeBytes(w http.ResponseWriter, r *http.Request, name string, data []byte, modTime time.Time) {
+	if w.Header().Get("Content-Type") == "" && path.Ext(name) != "" {
+		w.Header().Set("Content-Type", u.MimeTypeFromFileName(name))
+	}
+	if r == nil {
+		// used by server.IterContent, in that case w is a file
+		w.Write(data)
+		return
+	}
+	if w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", MakeETag(data))
+	}
+	http.ServeContent(w, r, name, modTime, bytes.NewReader(data))
+}
+
 func TryServeFileFromFS(w http.ResponseWriter, r *http.Request, opts *ServeFileOptions, fsPath string) bool {
 	return serveFileFromFS(w, r, opts, fsPath)
 }
@@ -109,64 +139,162 @@ func TryServeURLFromFS(w http.ResponseWriter, r *http.Request, opts *ServeFileOp
 	if isLongLived {
 		// 31536000 seconds is a year
 		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else if opts.DefaultMaxAge > 0 {
+		maxAge := int64(opts.DefaultMaxAge / time.Second)
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
 	}
 
 	return serveFileFromFS(w, r, opts, fsPath)
 }
 
-func canServeBr(r *http.Request) bool {
-	enc := r.Header.Get("Accept-Encoding")
-	return strings.Contains(enc, "br")
+// BestEncoding returns the encoding from supported that is most preferred
+// by the client, based on Accept-Encoding header with q-values
+// e.g. "gzip;q=0.8, br". If client likes a few encodings equally, we pick
+// the one that is earlier in supported.
+// Returns "identity" if none of supported encodings is acceptable
+func BestEncoding(r *http.Request, supported []string) string {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(part, ";")
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		if enc == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(param, "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(k), "q") {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		accepted[enc] = q
+	}
+
+	best := "identity"
+	bestQ := 0.0
+	for _, enc := range supported {
+		q, ok := accepted[strings.ToLower(enc)]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best = enc
+			bestQ = q
+		}
+	}
+	return best
+}
+
+func shouldServeCompressed(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".html", ".txt", ".css", ".js", ".xml", ".svg":
+		// those we serve compressed
+		return true
+	}
+	// other formats, e.g. png, should not be served compressed
+	return false
+}
+
+type compressedFile struct {
+	// size and modification time of the file we compressed,
+	// to detect it changed
+	size    int64
+	modTime time.Time
+	data    []byte
 }
 
-// if we have a *.br version in opts.FS, serve it
+// returns compressed version of path, re-using cached one if the file
+// didn't change since we compressed it
+func compressFileCached(opts *ServeFileOptions, path string, enc string) ([]byte, error) {
+	fi, err := fs.Stat(opts.FS, path)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := path + "." + enc
+	serveFileMu.Lock()
+	cf := opts.compressedCached[cacheKey]
+	serveFileMu.Unlock()
+	if cf != nil && cf.size == fi.Size() && cf.modTime.Equal(fi.ModTime()) {
+		return cf.data, nil
+	}
+
+	d, err := fs.ReadFile(opts.FS, path)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if enc == "br" {
+		data, err = u.BrCompressDataBest(d)
+	} else {
+		data, err = u.GzipCompressData(d)
+	}
+	if err != nil {
+		return nil, err
+	}
+	serveFileMu.Lock()
+	if opts.compressedCached == nil {
+		opts.compressedCached = make(map[string]*compressedFile)
+	}
+	opts.compressedCached[cacheKey] = &compressedFile{
+		size:    fi.Size(),
+		modTime: fi.ModTime(),
+		data:    data,
+	}
+	serveFileMu.Unlock()
+	return data, nil
+}
+
+// if client accepts br and we have a *.br version in opts.FS, serve it.
+// if client accepts gzip and we have *.gz version, serve it.
 // otherwise compress on demand if opts.ServeCompressed is true
-func serveFileMaybeBr(w http.ResponseWriter, r *http.Request, opts *ServeFileOptions, path string) bool {
-	if r == nil || !canServeBr(r) {
+func serveFileMaybeCompressed(w http.ResponseWriter, r *http.Request, opts *ServeFileOptions, path string) bool {
+	if r == nil {
 		return false
 	}
-	fsys := opts.FS
-	brData, err := fs.ReadFile(fsys, path+".br")
-	if err != nil {
+	// encodings acceptable to the client, most preferred first
+	var encodings []string
+	enc := BestEncoding(r, []string{"br", "gzip"})
+	switch enc {
+	case "br":
+		encodings = []string{"br"}
+		if BestEncoding(r, []string{"gzip"}) == "gzip" {
+			encodings = append(encodings, "gzip")
+		}
+	case "gzip":
+		encodings = []string{"gzip"}
+	default:
+		return false
+	}
+	exts := map[string]string{
+		"br":   ".br",
+		"gzip": ".gz",
+	}
+
+	var data []byte
+	for _, e := range encodings {
+		d, err := fs.ReadFile(opts.FS, path+exts[e])
+		if err == nil && len(d) > 0 {
+			data = d
+			enc = e
+			break
+		}
+	}
+	if len(data) == 0 {
 		// compress on demand
-		if !opts.ServeCompressed {
+		if !opts.ServeCompressed || !shouldServeCompressed(path) {
 			return false
 		}
-		ext := strings.ToLower(filepath.Ext(path))
-		switch ext {
-		case ".html", ".txt", ".css", ".js", ".xml", ".svg":
-			// those we serve compressed
-		default:
-			// other formats, e.g. png, should not be served compressed
-			// fmt.Printf("serveFileMaybeBr: skipping because '%s' not served as br because '%s' should not be served compressed\n", path, ext)
+		var err error
+		data, err = compressFileCached(opts, path, enc)
+		if err != nil || len(data) == 0 {
 			return false
 		}
-		serveFileMu.Lock()
-		if opts.compressedCached == nil {
-			opts.compressedCached = make(map[string][]byte)
-		}
-		brData = opts.compressedCached[path]
-		serveFileMu.Unlock()
-		if len(brData) == 0 {
-			d, err := fs.ReadFile(fsys, path)
-			if err != nil {
-				return false
-			}
-			brData, err = u.BrCompressDataBest(d)
-			if err != nil {
-				return false
-			}
-		}
-	}
-
-	if len(brData) == 0 {
-		return false
 	}
 
-	serveFileMu.Lock()
-	opts.compressedCached[path] = brData
-	serveFileMu.Unlock()
-
 	ct := u.MimeTypeFromFileName(path)
 	if ct != "" {
 		w.Header().Set("Content-Type", ct)
@@ -174,9 +302,8 @@ func serveFileMaybeBr(w http.ResponseWriter, r *http.Request, opts *ServeFileOpt
 	// https://www.maxcdn.com/blog/accept-encoding-its-vary-important/
 	// prevent caching non-compressed version
 	w.Header().Add("Vary", "Accept-Encoding")
-	w.Header().Set("Content-Encoding", "br")
-	f := bytes.NewReader(brData)
+	w.Header().Set("Content-Encoding", enc)
+	f := bytes.NewReader(data)
 	http.ServeContent(w, r, path, globalModTime, f)
-	// fmt.Printf("serveFileMaybeBr: served '%s'\n", pathBr)
 	return true
 }
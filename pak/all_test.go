@@ -1,6 +1,7 @@
 package pak
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"testing"
@@ -154,6 +155,80 @@ func writeReadArchiveTests(t *testing.T, archivePath string, tests []*test) {
 
 }
 
+func TestReadArchiveReader(t *testing.T) {
+	tests := []*test{
+		mkFile("reader.go"),
+		mkData([]byte{0x0, 0x1, 0x3, 0x0}, "some_data.dat"),
+		mkData([]byte{}, "empty_file.txt"),
+	}
+	w := NewWriter()
+	for _, test := range tests {
+		var err error
+		if test.isFile {
+			err = w.AddFile(test.path, Metadata{})
+		} else {
+			err = w.AddData(test.data, test.path, Metadata{})
+		}
+		assert.NoError(t, err)
+	}
+	var buf bytes.Buffer
+	err := w.Write(&buf)
+	assert.NoError(t, err)
+	d := buf.Bytes()
+
+	a, err := ReadArchiveReader(bytes.NewReader(d), int64(len(d)))
+	assert.NoError(t, err)
+	assert.Equal(t, "", a.Path)
+	assert.Equal(t, len(tests), len(a.Entries))
+	for i, e := range a.Entries {
+		got, err := a.ReadEntry(e)
+		assert.NoError(t, err)
+		assert.Equal(t, tests[i].path, e.Path)
+		assert.Equal(t, tests[i].data, got)
+	}
+
+	// truncated archive
+	d = d[:len(d)-2]
+	_, err = ReadArchiveReader(bytes.NewReader(d), int64(len(d)))
+	assert.Error(t, err)
+}
+
+func TestList(t *testing.T) {
+	w := NewWriter()
+	var meta Metadata
+	meta.Set("Type", "text file")
+	err := w.AddData([]byte("hello"), "b.txt", meta)
+	assert.NoError(t, err)
+	err = w.AddData(make([]byte, 2048), "a/zeros.dat", Metadata{})
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	err = w.Write(&buf)
+	assert.NoError(t, err)
+	d := buf.Bytes()
+
+	a, err := ReadArchiveReader(bytes.NewReader(d), int64(len(d)))
+	assert.NoError(t, err)
+	list := a.List()
+	assert.Equal(t, 2, len(list))
+
+	e := list[0]
+	assert.Equal(t, "a/zeros.dat", e.Path)
+	assert.Equal(t, int64(2048), e.Size)
+	assert.Equal(t, "2 kB", e.SizeHuman)
+	assert.Equal(t, sha1HexOfBytes(make([]byte, 2048)), e.Sha1)
+	assert.Equal(t, 0, len(e.Meta))
+
+	e = list[1]
+	assert.Equal(t, "b.txt", e.Path)
+	assert.Equal(t, int64(5), e.Size)
+	assert.Equal(t, "5 bytes", e.SizeHuman)
+	assert.Equal(t, sha1HexOfBytes([]byte("hello")), e.Sha1)
+	assert.Equal(t, []KV{{Key: "Type", Value: "text file"}}, e.Meta)
+
+	// Entries keep the order in which they were written
+	assert.Equal(t, "b.txt", a.Entries[0].Path)
+}
+
 func TestBug(t *testing.T) {
 	tests := []*test{
 		// siser had issues when reading a record followed by record
@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strconv"
 
 	"github.com/kjk/common/siser"
+	"github.com/kjk/common/u"
 )
 
 var (
@@ -49,6 +51,9 @@ type Archive struct {
 
 	// if true, will disable validating sha1 on reading
 	DisableValidateSha1 bool
+
+	// if set, ReadEntry reads from ra instead of a file in Path
+	ra io.ReaderAt
 }
 
 // ReadArchive reads archive from a file
@@ -58,14 +63,40 @@ func ReadArchive(path string) (*Archive, error) {
 		return nil, err
 	}
 	defer f.Close()
-	a, err := ReadArchiveFromReader(f)
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	a, err := ReadArchiveReader(f, st.Size())
 	if err != nil {
 		return nil, err
 	}
+	// f is closed when we return so ReadEntry
+	// must re-open the file
+	a.ra = nil
 	a.Path = path
 	return a, nil
 }
 
+// ReadArchiveReader reads archive from ra of a given size
+// e.g. from memory via bytes.Reader.
+// Unlike ReadArchiveFromReader, ReadEntry works on returned
+// archive as long as ra is valid.
+func ReadArchiveReader(ra io.ReaderAt, size int64) (*Archive, error) {
+	r := io.NewSectionReader(ra, 0, size)
+	a, err := ReadArchiveFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range a.Entries {
+		if e.Offset+e.Size > size {
+			return nil, fmt.Errorf("entry '%s' at offset %d of size %d is past the end of archive of size %d", e.Path, e.Offset, e.Size, size)
+		}
+	}
+	a.ra = ra
+	return a, nil
+}
+
 // ReadArchiveFromReader reads archive entries
 func ReadArchiveFromReader(r io.Reader) (*Archive, error) {
 	br := bufio.NewReader(r)
@@ -153,11 +184,24 @@ func readFileChunk(path string, offset, size int64) ([]byte, error) {
 }
 
 // ReadEntry reads a given entry from file in Path
+// or io.ReaderAt given to ReadArchiveReader
 func (a *Archive) ReadEntry(e *Entry) ([]byte, error) {
-	if a.Path == "" {
-		return nil, ErrNoPath
+	var d []byte
+	var err error
+	if a.ra != nil {
+		d = make([]byte, int(e.Size))
+		var n int
+		n, err = a.ra.ReadAt(d, e.Offset)
+		// ReadAt can return io.EOF if reading up to the end
+		if n == len(d) {
+			err = nil
+		}
+	} else {
+		if a.Path == "" {
+			return nil, ErrNoPath
+		}
+		d, err = readFileChunk(a.Path, e.Offset, e.Size)
 	}
-	d, err := readFileChunk(a.Path, e.Offset, e.Size)
 	if err != nil {
 		return nil, err
 	}
@@ -169,3 +213,39 @@ func (a *Archive) ReadEntry(e *Entry) ([]byte, error) {
 	}
 	return d, nil
 }
+
+// EntryInfo is a summary of an Entry, for listing archive content
+type EntryInfo struct {
+	Path string
+	Size int64
+	// human-readable size e.g. "1.24 kB"
+	SizeHuman string
+	Sha1      string
+	// metadata other than Path, Size and Sha1
+	Meta []KV
+}
+
+// List returns information about entries, sorted by path
+func (a *Archive) List() []EntryInfo {
+	var res []EntryInfo
+	for _, e := range a.Entries {
+		info := EntryInfo{
+			Path:      e.Path,
+			Size:      e.Size,
+			SizeHuman: u.FormatSize(e.Size),
+			Sha1:      e.Sha1,
+		}
+		for _, kv := range e.Metadata.Meta {
+			switch kv.Key {
+			case MetaKeyPath, MetaKeySize, MetaKeySha1:
+				continue
+			}
+			info.Meta = append(info.Meta, kv)
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Path < res[j].Path
+	})
+	return res
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/kjk/common/httputil"
 	"github.com/kjk/common/u"
 )
 
@@ -16,18 +17,23 @@ type EmbedFSHandler struct {
 	URLPrefix string
 	urls      []string
 	paths     []string // same order as URL
+	etags     []string // same order as URL
 	modTime   time.Time
 }
 
 func NewEmbedFSHandler(fsys embed.FS, dirPrefix, urlPrefix string) *EmbedFSHandler {
-	var urls, paths []string
+	var urls, paths, etags []string
 	u.IterReadDirFS(fsys, dirPrefix, func(filePath string, d fs.DirEntry) error {
 		dir := strings.TrimPrefix(filePath, dirPrefix)
 		dir = strings.TrimPrefix(dir, dirPrefix)
 		// embed.FS uses "/" as path separator
 		uri := path.Join(urlPrefix, dir)
+		// embedded files don't change so calculate ETag once
+		data, err := fs.ReadFile(fsys, filePath)
+		u.PanicIfErr(err)
 		urls = append(urls, uri)
 		paths = append(paths, filePath)
+		etags = append(etags, httputil.MakeETag(data))
 		return nil
 	})
 	u.PanicIf(len(urls) == 0)
@@ -36,6 +42,7 @@ func NewEmbedFSHandler(fsys embed.FS, dirPrefix, urlPrefix string) *EmbedFSHandl
 		URLPrefix: urlPrefix,
 		urls:      urls,
 		paths:     paths,
+		etags:     etags,
 		modTime:   time.Now(),
 	}
 }
@@ -55,7 +62,7 @@ func (h *EmbedFSHandler) Get(uri string) func(w http.ResponseWriter, r *http.Req
 			path := h.paths[i]
 			d, err := fs.ReadFile(h.fs, path)
 			u.PanicIfErr(err)
-			return MakeServeContent(uri, d, code, h.modTime)
+			return makeServeContentWithETag(uri, d, code, h.modTime, h.etags[i])
 		}
 	}
 	return nil
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
 	"compress/flate"
+	"compress/gzip"
 	"io"
 	"io/fs"
 	"net/http"
@@ -11,6 +13,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kjk/common/httputil"
@@ -29,6 +32,10 @@ type Server struct {
 	CleanURLS bool
 	// if true forces clean urls i.e. /foo.html will redirect to /foo
 	ForceCleanURLS bool
+	// if true, serves /index.html for unknown urls without extension
+	// (e.g. /some/deep/route) so that single-page apps can do
+	// client-side routing. Unknown assets (e.g. /foo.js) are still 404
+	SPAFallback bool
 }
 
 type HandlerFunc = func(w http.ResponseWriter, r *http.Request)
@@ -93,51 +100,91 @@ func serve404FileCached(w http.ResponseWriter, r *http.Request, path string, cac
 	w.Write(d)
 }
 
-func makeServeFile(path string, tryServeCompressed bool) func(w http.ResponseWriter, r *http.Request) {
+// serveFileCache re-uses ServeFileOptions for a given directory so that
+// files compressed on demand are cached across requests.
+// Cached data is re-compressed when a file changes
+type serveFileCache struct {
+	mu   sync.Mutex
+	opts map[string]*httputil.ServeFileOptions
+}
+
+func (c *serveFileCache) get(dir string, tryServeCompressed bool) *httputil.ServeFileOptions {
+	key := dir
+	if tryServeCompressed {
+		key += "\x00compressed"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	opts := c.opts[key]
+	if opts == nil {
+		opts = &httputil.ServeFileOptions{
+			FS:              os.DirFS(dir),
+			ServeCompressed: tryServeCompressed,
+		}
+		if c.opts == nil {
+			c.opts = map[string]*httputil.ServeFileOptions{}
+		}
+		c.opts[key] = opts
+	}
+	return opts
+}
+
+func makeServeFile(path string, tryServeCompressed bool, cache *serveFileCache) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(path, "404.html") {
 			serve404FileCached(w, r, path, nil)
 			return
 		}
 		dir := filepath.Dir(path)
-		fsys := os.DirFS(dir)
 		name := filepath.Base(path)
-		opts := httputil.ServeFileOptions{
-			FS:              fsys,
-			ServeCompressed: tryServeCompressed,
-		}
-		if !httputil.TryServeFileFromFS(w, r, &opts, name) {
+		opts := cache.get(dir, tryServeCompressed)
+		if !httputil.TryServeFileFromFS(w, r, opts, name) {
 			http.ServeFile(w, r, path)
 		}
 	}
 }
 
 // uri is only used to guess content type
-func serveContent(w http.ResponseWriter, r *http.Request, uri string, d []byte, code int, modTime time.Time) {
+// etag is optional, if empty we calculate it from d
+func serveContent(w http.ResponseWriter, r *http.Request, uri string, d []byte, code int, modTime time.Time, etag string) {
 	if r == nil {
 		_, err := w.Write(d)
 		must(err)
 		return
 	}
-	content := bytes.NewReader(d)
 	if code != http.StatusOK {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(code)
 		w.Write(d)
 		return
 	}
-	http.ServeContent(w, r, uri, modTime, content)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	httputil.ServeBytes(w, r, uri, d, modTime)
 }
 
-func MakeServeContent(uri string, d []byte, code int, modTime time.Time) func(w http.ResponseWriter, r *http.Request) {
+func makeServeContentWithETag(uri string, d []byte, code int, modTime time.Time, etag string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		serveContent(w, r, uri, d, code, modTime)
+		serveContent(w, r, uri, d, code, modTime, etag)
 	}
 }
 
+// MakeServeContent returns a handler that serves d. ETag is calculated
+// once, so re-use the returned handler if d is served many times
+func MakeServeContent(uri string, d []byte, code int, modTime time.Time) func(w http.ResponseWriter, r *http.Request) {
+	etag := ""
+	if code == http.StatusOK {
+		etag = httputil.MakeETag(d)
+	}
+	return makeServeContentWithETag(uri, d, code, modTime, etag)
+}
+
 type FilesHandler struct {
 	files              map[string]string // maps url to a path on disk
 	TryServeCompressed bool
+
+	cache serveFileCache
 }
 
 func (h *FilesHandler) AddFile(uri, path string) {
@@ -158,7 +205,7 @@ func (h *FilesHandler) Get(url string) func(w http.ResponseWriter, r *http.Reque
 	for uri, path := range h.files {
 		// we consider URLs case-insensitive
 		if strings.EqualFold(uri, url) {
-			return makeServeFile(path, h.TryServeCompressed)
+			return makeServeFile(path, h.TryServeCompressed, &h.cache)
 		}
 	}
 	return nil
@@ -192,13 +239,15 @@ type DirHandler struct {
 
 	URL   []string
 	paths []string // same order as URL
+
+	cache serveFileCache
 }
 
 func (h *DirHandler) Get(url string) func(w http.ResponseWriter, r *http.Request) {
 	for i, u := range h.URL {
 		// urls are case-insensitive
 		if strings.EqualFold(u, url) {
-			return makeServeFile(h.paths[i], h.TryServeCompressed)
+			return makeServeFile(h.paths[i], h.TryServeCompressed, &h.cache)
 		}
 	}
 	return nil
@@ -263,7 +312,57 @@ func NewDynamicHandler(get GetHandlerFunc, urls func() []string) *DynamicHandler
 
 type InMemoryFilesHandler struct {
 	files   map[string][]byte
+	etags   map[string]string // same keys as files
 	modTime time.Time
+	// if true, we serve .html, .js, .css etc. compressed with br or gzip,
+	// depending on Accept-Encoding. Compressed data is cached
+	TryServeCompressed bool
+
+	mu         sync.Mutex
+	compressed map[string]*compressedContent // ${uri}.${encoding} => compressed data
+}
+
+type compressedContent struct {
+	data []byte
+	etag string
+}
+
+// returns false if client doesn't accept compressed response
+func (h *InMemoryFilesHandler) serveCompressed(w http.ResponseWriter, r *http.Request, uri string, d []byte) bool {
+	enc := httputil.BestEncoding(r, []string{"br", "gzip"})
+	if enc == "identity" {
+		return false
+	}
+	key := uri + "." + enc
+	h.mu.Lock()
+	cc := h.compressed[key]
+	h.mu.Unlock()
+	if cc == nil {
+		var cd []byte
+		var err error
+		if enc == "br" {
+			cd, err = u.BrCompressDataBest(d)
+		} else {
+			cd, err = u.GzipCompressData(d)
+		}
+		if err != nil {
+			return false
+		}
+		cc = &compressedContent{
+			data: cd,
+			etag: httputil.MakeETag(cd),
+		}
+		h.mu.Lock()
+		if h.compressed == nil {
+			h.compressed = map[string]*compressedContent{}
+		}
+		h.compressed[key] = cc
+		h.mu.Unlock()
+	}
+	w.Header().Set("Content-Encoding", enc)
+	w.Header().Set("ETag", cc.etag)
+	httputil.ServeBytes(w, r, uri, cc.data, h.modTime)
+	return true
 }
 
 func (h *InMemoryFilesHandler) Get(uri string) func(http.ResponseWriter, *http.Request) {
@@ -273,7 +372,19 @@ func (h *InMemoryFilesHandler) Get(uri string) func(http.ResponseWriter, *http.R
 			if strings.HasSuffix(uri, "/404.html") {
 				code = http.StatusNotFound
 			}
-			return MakeServeContent(uri, d, code, h.modTime)
+			if code == http.StatusOK && h.TryServeCompressed && commonExt(path) {
+				return func(w http.ResponseWriter, r *http.Request) {
+					if r != nil {
+						// prevent caching non-compressed version
+						w.Header().Add("Vary", "Accept-Encoding")
+						if h.serveCompressed(w, r, path, d) {
+							return
+						}
+					}
+					serveContent(w, r, uri, d, code, h.modTime, h.etags[path])
+				}
+			}
+			return makeServeContentWithETag(uri, d, code, h.modTime, h.etags[path])
 		}
 	}
 	return nil
@@ -293,11 +404,18 @@ func (h *InMemoryFilesHandler) Add(uri string, body []byte) {
 	uri = strings.Replace(uri, "\\", "/", -1)
 	u.PanicIf(!strings.HasPrefix(uri, "/"))
 	h.files[uri] = body
+	h.etags[uri] = httputil.MakeETag(body)
+	// content might have changed
+	h.mu.Lock()
+	delete(h.compressed, uri+".br")
+	delete(h.compressed, uri+".gzip")
+	h.mu.Unlock()
 }
 
 func NewInMemoryFilesHandler(uri string, d []byte) *InMemoryFilesHandler {
 	h := &InMemoryFilesHandler{
 		files:   map[string][]byte{},
+		etags:   map[string]string{},
 		modTime: time.Now(),
 	}
 	h.Add(uri, d)
@@ -380,6 +498,9 @@ func makePermRedirect(uri string) func(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) FindHandler(uri string) (h HandlerFunc, is404 bool) {
+	// /foo/ is rewritten to /foo/index.html but for SPAFallback
+	// it's still an app route
+	isAppRoute := path.Ext(uri) == "" || strings.HasSuffix(uri, "/")
 	if strings.HasSuffix(uri, "/") {
 		uri = path.Join(uri, "/index.html")
 	}
@@ -397,16 +518,66 @@ func (s *Server) FindHandler(uri string) (h HandlerFunc, is404 bool) {
 			return h, false
 		}
 	}
+	// for single-page apps, app routes are handled by /index.html
+	// it must be checked before 404.html because a 404.html
+	// would otherwise handle them
+	if s.SPAFallback && isAppRoute {
+		if h = s.FindHandlerExact("/index.html"); h != nil {
+			return h, false
+		}
+	}
+
 	// try 404.html
 	a := Gen404Candidates(uri)
 	for _, uri404 := range a {
 		if h = s.FindHandlerExact(uri404); h != nil {
-			return h, true
+			return make404Handler(h), true
 		}
 	}
 	return nil, false
 }
 
+// notFoundWriter ensures 404 page is sent with http.StatusNotFound
+// even if the handler serving it thinks it's a regular page
+type notFoundWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *notFoundWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if statusCode < 400 {
+		statusCode = http.StatusNotFound
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *notFoundWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func make404Handler(h HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r == nil {
+			h(w, r)
+			return
+		}
+		// conditional and range requests would turn 404 page
+		// into 304 or 206 response without the body
+		r = r.Clone(r.Context())
+		for _, hdr := range []string{"If-Modified-Since", "If-None-Match", "If-Range", "Range"} {
+			r.Header.Del(hdr)
+		}
+		h(&notFoundWriter{ResponseWriter: w}, r)
+	}
+}
+
 // don't really use it
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	uri := r.URL.Path
@@ -476,3 +647,32 @@ func WriteServerFilesToZip(handlers []Handler, onWritten func(path string, d []b
 	IterContent(handlers, writeFile)
 	return buf.Bytes(), err
 }
+
+// WriteServerFilesToTarGz writes content of all urls to w as .tar.gz archive
+func WriteServerFilesToTarGz(handlers []Handler, w io.Writer) error {
+	gw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gw)
+	modTime := time.Now()
+
+	writeFile := func(uri string, d []byte) {
+		if err != nil {
+			return
+		}
+		hdr := &tar.Header{
+			Name:    strings.TrimPrefix(uri, "/"),
+			Mode:    0644,
+			Size:    int64(len(d)),
+			ModTime: modTime,
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return
+		}
+		_, err = tw.Write(d)
+	}
+	IterContent(handlers, writeFile)
+	return u.GetErr(err, tw.Close(), gw.Close())
+}
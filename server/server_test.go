@@ -1,10 +1,20 @@
 package server
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/kjk/common/assert"
+	"github.com/kjk/common/httputil"
 	"github.com/kjk/common/u"
 )
 
@@ -41,3 +51,279 @@ func TestTrimExt(t *testing.T) {
 		assert.Equal(t, exp, got)
 	}
 }
+
+func TestServe404(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "sub", "404.html"), []byte("sub not found"), 0644)
+	assert.NoError(t, err)
+
+	page404 := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("dynamic not found"))
+	}
+	get := func(uri string) HandlerFunc {
+		if uri == "/dyn/404.html" {
+			return page404
+		}
+		return nil
+	}
+	urls := func() []string {
+		return []string{"/dyn/404.html"}
+	}
+	srv := &Server{
+		Handlers: []Handler{
+			NewDirHandler(dir, "/", nil),
+			NewDynamicHandler(get, urls),
+		},
+	}
+
+	tests := []struct {
+		uri  string
+		code int
+		body string
+	}{
+		{"/sub/missing.html", http.StatusNotFound, "sub not found"},
+		{"/dyn/missing", http.StatusNotFound, "dynamic not found"},
+		{"/sub/404.html", http.StatusNotFound, "sub not found"},
+		{"/missing", http.StatusNotFound, "404 page not found\n"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.uri, nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		assert.Equal(t, test.code, w.Code, "uri: %s", test.uri)
+		assert.Equal(t, test.body, w.Body.String(), "uri: %s", test.uri)
+	}
+}
+
+func TestSPAFallback(t *testing.T) {
+	h := NewInMemoryFilesHandler("/index.html", []byte("app"))
+	h.Add("/404.html", []byte("not found"))
+	h.Add("/app.js", []byte("js"))
+	srv := &Server{
+		Handlers:    []Handler{h},
+		SPAFallback: true,
+	}
+
+	tests := []struct {
+		uri  string
+		code int
+		body string
+	}{
+		{"/some/deep/route", http.StatusOK, "app"},
+		{"/about", http.StatusOK, "app"},
+		{"/some/route/", http.StatusOK, "app"},
+		{"/", http.StatusOK, "app"},
+		{"/app.js", http.StatusOK, "js"},
+		{"/missing.js", http.StatusNotFound, "not found"},
+		{"/some/route/image.png", http.StatusNotFound, "not found"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.uri, nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		assert.Equal(t, test.code, w.Code, "uri: %s", test.uri)
+		assert.Equal(t, test.body, w.Body.String(), "uri: %s", test.uri)
+	}
+
+	srv.SPAFallback = false
+	r := httptest.NewRequest(http.MethodGet, "/some/deep/route", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDirHandlerGzip(t *testing.T) {
+	dir := t.TempDir()
+	css := bytes.Repeat([]byte("body { color: red; }\n"), 100)
+	err := os.WriteFile(filepath.Join(dir, "style.css"), css, 0644)
+	assert.NoError(t, err)
+	png := []byte("not really a png")
+	err = os.WriteFile(filepath.Join(dir, "img.png"), png, 0644)
+	assert.NoError(t, err)
+
+	h := NewDirHandler(dir, "/", nil)
+	h.TryServeCompressed = true
+	srv := &Server{
+		Handlers: []Handler{h},
+	}
+	get := func(uri string, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, uri, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, "uri: %s", uri)
+		return w
+	}
+
+	// twice to exercise caching
+	for i := 0; i < 2; i++ {
+		w := get("/style.css", "gzip, deflate")
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		d, err := u.GzipDecompressData(w.Body.Bytes())
+		assert.NoError(t, err)
+		assert.Equal(t, css, d)
+	}
+
+	// br is preferred
+	w := get("/style.css", "gzip, br")
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	d, err := u.BrDecompressData(w.Body.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, css, d)
+
+	w = get("/style.css", "")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, css, w.Body.Bytes())
+
+	// images are not compressed
+	w = get("/img.png", "gzip")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, png, w.Body.Bytes())
+
+	// pre-compressed sibling is served as is
+	err = os.WriteFile(filepath.Join(dir, "app.js"), []byte("let x = 1;"), 0644)
+	assert.NoError(t, err)
+	gz, err := u.GzipCompressData([]byte("let x = 2;"))
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "app.js.gz"), gz, 0644)
+	assert.NoError(t, err)
+	h.URL = append(h.URL, "/app.js")
+	h.paths = append(h.paths, filepath.Join(dir, "app.js"))
+	w = get("/app.js", "gzip")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, gz, w.Body.Bytes())
+
+	// .gz sibling is used when client prefers br but there's no .br sibling
+	h.TryServeCompressed = false
+	w = get("/app.js", "br, gzip")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, gz, w.Body.Bytes())
+	h.TryServeCompressed = true
+
+	// file changed after it was compressed and cached
+	css2 := bytes.Repeat([]byte("body { color: blue; }\n"), 100)
+	err = os.WriteFile(filepath.Join(dir, "style.css"), css2, 0644)
+	assert.NoError(t, err)
+	w = get("/style.css", "gzip")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	d, err = u.GzipDecompressData(w.Body.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, css2, d)
+}
+
+func TestWriteServerFilesToTarGz(t *testing.T) {
+	h := NewInMemoryFilesHandler("/index.html", []byte("index"))
+	h.Add("/css/main.css", []byte("body {}"))
+	h.Add("/empty.txt", nil)
+	handlers := []Handler{h}
+
+	var buf bytes.Buffer
+	err := WriteServerFilesToTarGz(handlers, &buf)
+	assert.NoError(t, err)
+
+	exp := map[string][]byte{}
+	IterContent(handlers, func(uri string, d []byte) {
+		exp[strings.TrimPrefix(uri, "/")] = append([]byte{}, d...)
+	})
+
+	gr, err := gzip.NewReader(&buf)
+	assert.NoError(t, err)
+	tr := tar.NewReader(gr)
+	got := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		d, err := io.ReadAll(tr)
+		assert.NoError(t, err)
+		got[hdr.Name] = d
+	}
+	assert.Equal(t, 3, len(got))
+	for name, d := range exp {
+		assert.Equal(t, string(d), string(got[name]), "name: %s", name)
+	}
+}
+
+func TestInMemoryFilesHandlerCompressed(t *testing.T) {
+	js := bytes.Repeat([]byte("console.log('hello');\n"), 100)
+	h := NewInMemoryFilesHandler("/app.js", js)
+	h.Add("/img.png", []byte("not really a png"))
+	h.TryServeCompressed = true
+	srv := &Server{
+		Handlers: []Handler{h},
+	}
+	get := func(uri string, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, uri, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, "uri: %s", uri)
+		return w
+	}
+
+	w := get("/app.js", "gzip")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	d, err := u.GzipDecompressData(w.Body.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, js, d)
+
+	w = get("/app.js", "gzip, br")
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	d, err = u.BrDecompressData(w.Body.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, js, d)
+
+	w = get("/app.js", "")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, js, w.Body.Bytes())
+
+	w = get("/img.png", "gzip")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+
+	// Add() invalidates cached compressed data
+	js2 := []byte("console.log('changed');")
+	h.Add("/app.js", js2)
+	w = get("/app.js", "gzip")
+	d, err = u.GzipDecompressData(w.Body.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, js2, d)
+}
+
+func TestInMemoryFilesHandlerETag(t *testing.T) {
+	d := []byte("<html>hello</html>")
+	h := NewInMemoryFilesHandler("/index.html", d)
+	srv := &Server{
+		Handlers: []Handler{h},
+	}
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, httputil.MakeETag(d), etag)
+	assert.Equal(t, h.etags["/index.html"], etag)
+
+	w = get(etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// changed content gets a new ETag
+	h.Add("/index.html", []byte("<html>changed</html>"))
+	w = get(etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<html>changed</html>", w.Body.String())
+	assert.True(t, w.Header().Get("ETag") != etag)
+}
@@ -15,6 +15,7 @@ type ZipHandler struct {
 
 	URL     []string
 	content [][]byte // same order as URL
+	etags   []string // same order as URL
 
 	modTime time.Time
 }
@@ -27,7 +28,7 @@ func (h *ZipHandler) Get(uri string) func(w http.ResponseWriter, r *http.Request
 			if strings.HasSuffix(uri, "/404.html") {
 				code = http.StatusNotFound
 			}
-			return MakeServeContent(uri, h.content[i], code, h.modTime)
+			return makeServeContentWithETag(uri, h.content[i], code, h.modTime, h.etags[i])
 		}
 	}
 	return nil
@@ -40,11 +41,13 @@ func (h *ZipHandler) URLS() []string {
 func NewZipHandler(zipData []byte, urlPrefix string) (*ZipHandler, error) {
 	var urls []string
 	var content [][]byte
+	var etags []string
 
 	err := u.IterZipData(zipData, func(f *zip.File, data []byte) error {
 		uri := httputil.JoinURL(urlPrefix, f.Name)
 		urls = append(urls, uri)
 		content = append(content, data)
+		etags = append(etags, httputil.MakeETag(data))
 		return nil
 	})
 	if err != nil {
@@ -55,6 +58,7 @@ func NewZipHandler(zipData []byte, urlPrefix string) (*ZipHandler, error) {
 		URLPrefix: urlPrefix,
 		URL:       urls,
 		content:   content,
+		etags:     etags,
 		modTime:   time.Now(),
 	}, nil
 }
@@ -0,0 +1,73 @@
+package siser
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// marshals s as json string, can't fail for strings
+func appendJSONString(buf *bytes.Buffer, s string) {
+	d, _ := json.Marshal(s)
+	buf.Write(d)
+}
+
+// appendRecordJSON appends rec as a single-line json object:
+// {"name":"httplog","timestamp":"2024-03-05T10:20:30.123Z","entries":{"url":"/"}}
+// Keys in entries are in the order they were written. If a key is
+// present more than once, its value is an array of all values
+func appendRecordJSON(buf *bytes.Buffer, rec *ReadRecord) {
+	buf.WriteString(`{"name":`)
+	appendJSONString(buf, rec.Name)
+	if !rec.Timestamp.IsZero() {
+		buf.WriteString(`,"timestamp":`)
+		appendJSONString(buf, rec.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	}
+	buf.WriteString(`,"entries":{`)
+	for i, e := range rec.Entries {
+		if _, ok := get(rec.Entries[:i], e.Key); ok {
+			// already written as part of an array
+			continue
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		appendJSONString(buf, e.Key)
+		buf.WriteByte(':')
+		var vals []string
+		for _, e2 := range rec.Entries[i+1:] {
+			if e2.Key == e.Key {
+				vals = append(vals, e2.Value)
+			}
+		}
+		if len(vals) == 0 {
+			appendJSONString(buf, e.Value)
+			continue
+		}
+		buf.WriteByte('[')
+		appendJSONString(buf, e.Value)
+		for _, v := range vals {
+			buf.WriteByte(',')
+			appendJSONString(buf, v)
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteString("}}\n")
+}
+
+// TranscodeToJSONL reads siser records from r and writes them to w
+// as JSON lines i.e. one json object per line, for tools that
+// understand json. See appendRecordJSON for the format
+func TranscodeToJSONL(r *bufio.Reader, w io.Writer) error {
+	reader := NewReader(r)
+	var buf bytes.Buffer
+	for reader.ReadNextRecord() {
+		buf.Reset()
+		appendRecordJSON(&buf, reader.Record)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return reader.Err()
+}
@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -13,8 +15,10 @@ import (
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/kjk/common/assert"
+	"github.com/kjk/common/u"
 )
 
 var (
@@ -94,6 +98,154 @@ func TestUnmarshalErrors(t *testing.T) {
 	}
 }
 
+func TestValidateRecordBytes(t *testing.T) {
+	valid := []string{
+		"",
+		"key: val\n",
+		"k2:+3\na\nb\n",
+		"k:+4\nabc\nk2: v\n",
+		"no value:+0\nbu: gatti\n",
+	}
+	for _, s := range valid {
+		assert.NoError(t, ValidateRecordBytes([]byte(s)), "s: '%s'", s)
+	}
+	invalid := []string{
+		"ha",
+		"ha\n",
+		"ha:\n",
+		"ha:_\n",
+		"ha:+32\nma",
+		"ha:+los\nma",
+		"ha:+-1\nma\n",
+		// wrong length prefixes
+		"k2:+2\na\nb\n",
+		"k2:+3\na\nbc\n",
+		"k2:+1\nab\nk: v\n",
+	}
+	for _, s := range invalid {
+		assert.Error(t, ValidateRecordBytes([]byte(s)), "s: '%s'", s)
+	}
+
+	var r Record
+	r.Write("k", "v", "long", largeValue, "multi", "a\nb", "empty", "")
+	assert.NoError(t, ValidateRecordBytes(r.Marshal()))
+}
+
+func TestRecordMerge(t *testing.T) {
+	var base Record
+	base.Name = "http"
+	base.Write("url", "/foo", "code", 200, "multi", "a\nb")
+	var extra Record
+	extra.Write("code", 404, "user", "kjk", "long", largeValue)
+	err := base.Merge(&extra)
+	assert.NoError(t, err)
+
+	exp := fmt.Sprintf("url: /foo\ncode: 404\nmulti:+3\na\nb\nuser: kjk\nlong:+%d\n%s\n", len(largeValue), largeValue)
+	assert.Equal(t, exp, string(base.Marshal()))
+	assert.Equal(t, "http", base.Name)
+	// other is not changed
+	assert.Equal(t, fmt.Sprintf("code: 404\nuser: kjk\nlong:+%d\n%s\n", len(largeValue), largeValue), string(extra.Marshal()))
+
+	rec, err := UnmarshalRecord(base.Marshal(), nil)
+	assert.NoError(t, err)
+	v, _ := rec.Get("code")
+	assert.Equal(t, "404", v)
+	assert.Equal(t, 5, len(rec.Entries))
+}
+
+func TestRecordMergeDuplicateKeys(t *testing.T) {
+	var a Record
+	a.Write("tag", "x", "url", "/")
+	var b Record
+	b.Write("tag", "1", "tag", "2", "new", "a", "new", "b")
+	err := a.Merge(&b)
+	assert.NoError(t, err)
+	exp := "tag: 1\nurl: /\ntag: 2\nnew: a\nnew: b\n"
+	assert.Equal(t, exp, string(a.Marshal()))
+}
+
+func TestRecordHasKeys(t *testing.T) {
+	var r Record
+	r.Write("url", "/foo", "code", 200, "url", "/bar")
+	rec, err := UnmarshalRecord(r.Marshal(), nil)
+	assert.NoError(t, err)
+	assert.True(t, rec.Has("url"))
+	assert.True(t, rec.Has("code"))
+	assert.False(t, rec.Has("missing"))
+	assert.False(t, rec.Has(""))
+	assert.Equal(t, []string{"url", "code", "url"}, rec.Keys())
+
+	rec.Reset()
+	assert.False(t, rec.Has("url"))
+	assert.Equal(t, 0, len(rec.Keys()))
+}
+
+func TestLongFormatThreshold(t *testing.T) {
+	v10 := "0123456789"
+	v11 := v10 + "a"
+	v150 := strings.Repeat("x", 150)
+
+	var r Record
+	r.Write("v10", v10, "v150", v150)
+	exp := fmt.Sprintf("v10: %s\nv150:+150\n%s\n", v10, v150)
+	assert.Equal(t, exp, string(r.Marshal()))
+
+	r.Reset()
+	r.LongFormatThreshold = 10
+	r.Write("v10", v10, "v11", v11)
+	exp = fmt.Sprintf("v10: %s\nv11:+11\n%s\n", v10, v11)
+	assert.Equal(t, exp, string(r.Marshal()))
+
+	// threshold survives Reset
+	r.Reset()
+	assert.Equal(t, 10, r.LongFormatThreshold)
+	r.LongFormatThreshold = 200
+	r.Write("v150", v150, "multi", "a\nb")
+	exp = fmt.Sprintf("v150: %s\nmulti:+3\na\nb\n", v150)
+	assert.Equal(t, exp, string(r.Marshal()))
+
+	// reading doesn't depend on the threshold
+	rec, err := UnmarshalRecord(r.Marshal(), nil)
+	assert.NoError(t, err)
+	v, _ := rec.Get("v150")
+	assert.Equal(t, v150, v)
+	v, _ = rec.Get("multi")
+	assert.Equal(t, "a\nb", v)
+}
+
+func TestRecordString(t *testing.T) {
+	var r Record
+	r.Name = "httplog"
+	r.Timestamp = time.Date(2024, 3, 5, 10, 20, 30, int(123*time.Millisecond), time.UTC)
+	r.Write("url", "/index.html", "code", 200, "ua", "Mozilla 5.0", "empty", "")
+	d := append([]byte{}, r.Marshal()...)
+	exp := `[httplog @ 2024-03-05 10:20:30.123] url=/index.html code=200 ua="Mozilla 5.0" empty=""`
+	assert.Equal(t, exp, r.String())
+	assert.Equal(t, exp, fmt.Sprintf("%s", &r))
+	// doesn't change marshalled data
+	assert.Equal(t, d, r.Marshal())
+
+	rec, err := UnmarshalRecord(d, nil)
+	assert.NoError(t, err)
+	rec.Name = r.Name
+	rec.Timestamp = r.Timestamp
+	assert.Equal(t, exp, rec.String())
+
+	r.Reset()
+	r.Name = ""
+	r.Write("long", largeValue, "multi", "a\nb")
+	exp = fmt.Sprintf("long=%s... multi=\"a\\nb\"", largeValue[:maxStringValueLen])
+	assert.Equal(t, exp, r.String())
+
+	// doesn't split multi-byte characters
+	r.Reset()
+	r.Write("pl", "a"+strings.Repeat("zażółć gęślą jaźń ", 8))
+	s := r.String()
+	assert.True(t, utf8.ValidString(s))
+	exp = `pl="azażółć gęślą jaźń zażółć gęślą jaźń zażół..."`
+	assert.Equal(t, exp, s)
+}
+
 func testWriterRoundTrip(t *testing.T, r *Record) {
 	var buf bytes.Buffer
 	w := NewWriter(&buf)
@@ -115,6 +267,7 @@ func testWriterRoundTrip(t *testing.T, r *Record) {
 // serialize and deserialize record and check the data is the same
 func testRoundTrip(t *testing.T, r *Record) string {
 	d := r.Marshal()
+	assert.NoError(t, ValidateRecordBytes(d))
 	rec, err := UnmarshalRecord(d, nil)
 	assert.NoError(t, err)
 	d2 := rec.Marshal()
@@ -402,6 +555,339 @@ func testMany(t *testing.T, name string) {
 	assert.Equal(t, nRecs, i)
 }
 
+func TestReaderSkip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	datas := []string{"no newline", "", "ends with newline\n", "x", "last"}
+	for i, d := range datas {
+		_, err := w.Write([]byte(d), time.Now(), "rec"+strconv.Itoa(i))
+		assert.NoError(t, err)
+	}
+	d := buf.Bytes()
+
+	for skip := 0; skip < len(datas); skip++ {
+		reader := NewReader(bufio.NewReader(bytes.NewReader(d)))
+		err := reader.Skip(skip)
+		assert.NoError(t, err)
+		assert.True(t, reader.ReadNextData(), "skip: %d", skip)
+		assert.Equal(t, datas[skip], string(reader.Data))
+		assert.Equal(t, "rec"+strconv.Itoa(skip), reader.Name)
+
+		// positions must match reading without skipping
+		reader2 := NewReader(bufio.NewReader(bytes.NewReader(d)))
+		for i := 0; i <= skip; i++ {
+			assert.True(t, reader2.ReadNextData())
+		}
+		assert.Equal(t, reader2.CurrRecordPos, reader.CurrRecordPos)
+		assert.Equal(t, reader2.NextRecordPos, reader.NextRecordPos)
+	}
+
+	reader := NewReader(bufio.NewReader(bytes.NewReader(d)))
+	err := reader.Skip(len(datas) + 1)
+	assert.Equal(t, io.EOF, err)
+
+	// truncated data
+	reader = NewReader(bufio.NewReader(bytes.NewReader(d[:len(d)-3])))
+	err = reader.Skip(len(datas))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, io.ErrUnexpectedEOF, reader.Err())
+}
+
+func TestTranscodeToJSONL(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var rec Record
+	rec.Name = "httplog"
+	rec.Timestamp = time.Date(2024, 3, 5, 10, 20, 30, int(123*time.Millisecond), time.UTC)
+	rec.Write("url", "/index.html", "code", 200, "tag", "a", "multi", "line1\nline2", "tag", "b")
+	_, err := w.WriteRecord(&rec)
+	assert.NoError(t, err)
+	rec.Reset()
+	rec.Name = ""
+	rec.Timestamp = time.Date(2024, 3, 5, 10, 20, 31, 0, time.UTC)
+	rec.Write("quote", `say "hi"`)
+	_, err = w.WriteRecord(&rec)
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	err = TranscodeToJSONL(bufio.NewReader(&buf), &out)
+	assert.NoError(t, err)
+	exp := `{"name":"httplog","timestamp":"2024-03-05T10:20:30.123Z","entries":{"url":"/index.html","code":"200","tag":["a","b"],"multi":"line1\nline2"}}
+{"name":"","timestamp":"2024-03-05T10:20:31.000Z","entries":{"quote":"say \"hi\""}}
+`
+	assert.Equal(t, exp, out.String())
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var m map[string]any
+		err = json.Unmarshal([]byte(line), &m)
+		assert.NoError(t, err)
+	}
+
+	err = TranscodeToJSONL(bufio.NewReader(strings.NewReader("--- invalid\n")), &out)
+	assert.Error(t, err)
+}
+
+func TestWriteRecordAt(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("existing data\n")
+	startPos := int64(buf.Len())
+	w := NewWriterAt(&buf, startPos)
+	rec := &Record{}
+	var positions []int64
+	currPos := startPos
+	for i := 0; i < 5; i++ {
+		rec.Write("counter", strconv.Itoa(i))
+		if i == 2 {
+			rec.Write("large", largeValue)
+		}
+		pos, n, err := w.WriteRecordAt(rec)
+		assert.NoError(t, err)
+		assert.Equal(t, currPos, pos)
+		positions = append(positions, pos)
+		currPos += int64(n)
+	}
+	assert.Equal(t, int64(buf.Len()), currPos)
+
+	d := buf.Bytes()
+	for i, pos := range positions {
+		reader := NewReader(bufio.NewReader(bytes.NewReader(d[pos:])))
+		assert.True(t, reader.ReadNextRecord())
+		v, _ := reader.Record.Get("counter")
+		assert.Equal(t, strconv.Itoa(i), v)
+	}
+}
+
+func TestBudgetWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewBudgetWriter(&buf, 64)
+	w.NoTimestamp = true
+	rec := &Record{}
+	nRecs := 0
+	var err error
+	for i := 0; i < 100; i++ {
+		rec.Write("counter", strconv.Itoa(i))
+		_, err = w.WriteRecord(rec)
+		if err != nil {
+			break
+		}
+		nRecs++
+	}
+	assert.True(t, errors.Is(err, ErrBudgetExceeded))
+	assert.True(t, nRecs > 0)
+	assert.True(t, buf.Len() <= 64)
+
+	// data written before exceeding the budget is valid
+	reader := NewReader(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	reader.NoTimestamp = true
+	n := 0
+	for reader.ReadNextRecord() {
+		n++
+	}
+	assert.NoError(t, reader.Err())
+	assert.Equal(t, nRecs, n)
+}
+
+func TestBudgetWriterAt(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriterAt(&buf, 1000)
+	w.NoTimestamp = true
+	w.MaxBytes = 64
+	rec := &Record{}
+	rec.Write("counter", "0")
+	pos, n, err := w.WriteRecordAt(rec)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), pos)
+	// budget doesn't include the starting position
+	var err2 error
+	for i := 1; i < 100 && err2 == nil; i++ {
+		rec.Write("counter", strconv.Itoa(i))
+		_, _, err2 = w.WriteRecordAt(rec)
+	}
+	assert.True(t, errors.Is(err2, ErrBudgetExceeded))
+	assert.True(t, buf.Len() > n)
+	assert.True(t, buf.Len() <= 64)
+
+	// no limit
+	w = NewBudgetWriter(&buf, 0)
+	rec.Write("large", largeValue)
+	_, err = w.WriteRecord(rec)
+	assert.NoError(t, err)
+}
+
+func TestNewReaderFromFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "log.txt")
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	w := NewWriter(f)
+	rec := &Record{}
+	for i := 0; i < 5; i++ {
+		rec.Write("counter", strconv.Itoa(i), "large", largeValue)
+		_, err = w.WriteRecord(rec)
+		assert.NoError(t, err)
+	}
+	err = f.Close()
+	assert.NoError(t, err)
+
+	pathBr := path + ".br"
+	err = u.BrCompressFileDefault(pathBr, path)
+	assert.NoError(t, err)
+
+	for _, path := range []string{path, pathBr} {
+		r, close, err := NewReaderFromFile(path)
+		assert.NoError(t, err)
+		n := 0
+		for r.ReadNextRecord() {
+			v, _ := r.Record.Get("counter")
+			assert.Equal(t, strconv.Itoa(n), v)
+			v, _ = r.Record.Get("large")
+			assert.Equal(t, largeValue, v)
+			n++
+		}
+		assert.NoError(t, r.Err())
+		assert.Equal(t, 5, n)
+		assert.NoError(t, close())
+	}
+
+	_, _, err = NewReaderFromFile(filepath.Join(dir, "missing.txt"))
+	assert.Error(t, err)
+}
+
+func TestRecordsIter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	rec := &Record{}
+	for i := 0; i < 5; i++ {
+		rec.Name = "iter"
+		rec.Write("counter", strconv.Itoa(i))
+		_, err := w.WriteRecord(rec)
+		assert.NoError(t, err)
+	}
+	d := buf.Bytes()
+
+	var exp []string
+	reader := NewReader(bufio.NewReader(bytes.NewBuffer(d)))
+	for reader.ReadNextRecord() {
+		v, _ := reader.Record.Get("counter")
+		exp = append(exp, v)
+	}
+	assert.NoError(t, reader.Err())
+
+	var got []string
+	reader = NewReader(bufio.NewReader(bytes.NewBuffer(d)))
+	for rec, err := range reader.Records() {
+		assert.NoError(t, err)
+		assert.Equal(t, "iter", rec.Name)
+		v, _ := rec.Get("counter")
+		got = append(got, v)
+	}
+	assert.Equal(t, exp, got)
+	assert.Equal(t, 5, len(got))
+
+	// early break
+	reader = NewReader(bufio.NewReader(bytes.NewBuffer(d)))
+	n := 0
+	for range reader.Records() {
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	assert.Equal(t, 2, n)
+
+	// error is reported as the last value
+	reader = NewReader(bufio.NewReader(bytes.NewBufferString("--- foo\n")))
+	var lastErr error
+	for rec, err := range reader.Records() {
+		assert.Nil(t, rec)
+		lastErr = err
+	}
+	assert.Error(t, lastErr)
+}
+
+func TestRejectDuplicateKeys(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	rec := &Record{}
+	rec.Write("key", "v1", "other", "v2", "key", "v3")
+	_, err := w.WriteRecord(rec)
+	assert.NoError(t, err)
+	d := buf.Bytes()
+
+	// lenient by default, Get returns the first value
+	reader := NewReader(bufio.NewReader(bytes.NewBuffer(d)))
+	assert.True(t, reader.ReadNextRecord())
+	v, ok := reader.Record.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "v1", v)
+
+	reader = NewReader(bufio.NewReader(bytes.NewBuffer(d)))
+	reader.RejectDuplicateKeys = true
+	assert.False(t, reader.ReadNextRecord())
+	err = reader.Err()
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "'key'"))
+}
+
+func TestAllowedNames(t *testing.T) {
+	tests := []*testRec{
+		mkTestRec("a: b\n", "httplog"),
+		mkTestRec("c: d\n", "event"),
+		mkTestRec("e: f\n", "evnet"),
+	}
+	d := writeData(t, tests).Bytes()
+
+	// permissive by default
+	reader := NewReader(bufio.NewReader(bytes.NewReader(d)))
+	n := 0
+	for reader.ReadNextRecord() {
+		n++
+	}
+	assert.NoError(t, reader.Err())
+	assert.Equal(t, 3, n)
+
+	reader = NewReader(bufio.NewReader(bytes.NewReader(d)))
+	reader.AllowedNames = map[string]bool{"httplog": true, "event": true}
+	n = 0
+	for reader.ReadNextRecord() {
+		n++
+	}
+	assert.Equal(t, 2, n)
+	err := reader.Err()
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "'evnet'"))
+}
+
+func TestMaxEntries(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		sb.WriteString("k: v\n")
+	}
+	d := []byte(sb.String())
+
+	rec, err := UnmarshalRecordMaxEntries(d, nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, len(rec.Entries))
+	rec, err = UnmarshalRecordMaxEntries(d, nil, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, len(rec.Entries))
+	_, err = UnmarshalRecordMaxEntries(d, nil, 999)
+	assert.True(t, errors.Is(err, ErrTooManyEntries))
+
+	tests := []*testRec{
+		mkTestRec("a: b\nc: d\n", "small"),
+		mkTestRec(sb.String(), "big"),
+	}
+	d = writeData(t, tests).Bytes()
+	reader := NewReader(bufio.NewReader(bytes.NewReader(d)))
+	reader.MaxEntries = 10
+	n := 0
+	for reader.ReadNextRecord() {
+		n++
+	}
+	assert.Equal(t, 1, n)
+	assert.True(t, errors.Is(reader.Err(), ErrTooManyEntries))
+}
+
 func TestWritePanics(t *testing.T) {
 	rec := &Record{}
 	assert.Error(t, rec.Write("foo"))
@@ -5,8 +5,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"iter"
 	"strconv"
 	"time"
+
+	"github.com/kjk/common/u"
 )
 
 // Reader is for reading (deserializing) records from a bufio.Reader
@@ -18,6 +21,19 @@ type Reader struct {
 	// read timestamp if it's written even if NoTimestamp is true
 	NoTimestamp bool
 
+	// if true, ReadNextRecord fails if a record has
+	// the same key more than once
+	RejectDuplicateKeys bool
+
+	// if set, reading a record with a name not in AllowedNames
+	// is an error
+	AllowedNames map[string]bool
+
+	// if > 0, ReadNextRecord fails with ErrTooManyEntries if a record
+	// has more entries than that. Protects from allocating huge
+	// Entries for corrupt data
+	MaxEntries int
+
 	// Record is available after ReadNextRecord().
 	// It's over-written in next ReadNextRecord().
 	Record *ReadRecord
@@ -50,6 +66,18 @@ func NewReader(r *bufio.Reader) *Reader {
 	}
 }
 
+// NewReaderFromFile creates a reader for a file that might be compressed
+// (e.g. rotated log saved as .txt.br), based on file extension.
+// Call returned function to close the file.
+func NewReaderFromFile(path string) (*Reader, func() error, error) {
+	f, err := u.OpenFileMaybeCompressed(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := NewReader(bufio.NewReader(f))
+	return r, f.Close, nil
+}
+
 // Done returns true if we're finished reading from the reader
 func (r *Reader) Done() bool {
 	return r.err != nil || r.done
@@ -57,14 +85,11 @@ func (r *Reader) Done() bool {
 
 var hdrPrefix = []byte("--- ")
 
-// ReadNextData reads next block from the reader, returns false
-// when no more record. If returns false, check Err() to see
-// if there were errors.
-// After reading Data containst data, and Timestamp and (optional) Name
-// contain meta-data
-func (r *Reader) ReadNextData() bool {
+// readHeader reads and parses record header, sets Name, Timestamp
+// and CurrRecordPos. Returns size of data and size of the header
+func (r *Reader) readHeader() (int64, int, bool) {
 	if r.Done() {
-		return false
+		return 0, 0, false
 	}
 	r.Name = ""
 	r.CurrRecordPos = r.NextRecordPos
@@ -81,7 +106,7 @@ func (r *Reader) ReadNextData() bool {
 		} else {
 			r.err = err
 		}
-		return false
+		return 0, 0, false
 	}
 	recSize := len(hdr)
 
@@ -95,7 +120,7 @@ func (r *Reader) ReadNextData() bool {
 		if !r.NoTimestamp {
 			// with timestamp, we need at least 2 values separated by space
 			r.err = fmt.Errorf("unexpected header '%s'", string(hdr))
-			return false
+			return 0, 0, false
 		}
 		dataSize = rest
 		rest = nil
@@ -123,18 +148,35 @@ func (r *Reader) ReadNextData() bool {
 	size, err := strconv.ParseInt(string(dataSize), 10, 64)
 	if err != nil {
 		r.err = fmt.Errorf("unexpected header '%s'", string(hdr))
-		return false
+		return 0, 0, false
 	}
 
 	if len(timestamp) > 0 {
 		timeMs, err := strconv.ParseInt(string(timestamp), 10, 64)
 		if err != nil {
 			r.err = fmt.Errorf("unexpected header '%s'", string(hdr))
-			return false
+			return 0, 0, false
 		}
 		r.Timestamp = TimeFromUnixMillisecond(timeMs)
 	}
 	r.Name = string(name)
+	if r.AllowedNames != nil && !r.AllowedNames[r.Name] {
+		r.err = fmt.Errorf("record with unexpected name '%s' at position %d", r.Name, r.CurrRecordPos)
+		return 0, 0, false
+	}
+	return size, recSize, true
+}
+
+// ReadNextData reads next block from the reader, returns false
+// when no more record. If returns false, check Err() to see
+// if there were errors.
+// After reading Data containst data, and Timestamp and (optional) Name
+// contain meta-data
+func (r *Reader) ReadNextData() bool {
+	size, recSize, ok := r.readHeader()
+	if !ok {
+		return false
+	}
 
 	// we try to re-use r.Data as long as it doesn't grow too much
 	// (limit to 1 MB)
@@ -172,6 +214,43 @@ func (r *Reader) ReadNextData() bool {
 	return true
 }
 
+// Skip advances past n records without copying their data into Data.
+// It's faster than calling ReadNextData n times.
+// Name and Timestamp are set from the last skipped record.
+// Returns io.EOF if there are less than n records
+func (r *Reader) Skip(n int) error {
+	for i := 0; i < n; i++ {
+		size, recSize, ok := r.readHeader()
+		if !ok {
+			if r.err != nil {
+				return r.err
+			}
+			return io.EOF
+		}
+		if size > 0 {
+			_, err := r.r.Discard(int(size - 1))
+			if err == nil {
+				// need last byte to know if data was padded with '\n'
+				var last byte
+				last, err = r.r.ReadByte()
+				if err == nil && last != '\n' {
+					_, err = r.r.Discard(1)
+					recSize++
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				r.err = err
+				return err
+			}
+		}
+		r.NextRecordPos += int64(recSize) + size
+	}
+	return nil
+}
+
 // ReadNextRecord reads a key / value record.
 // Returns false if there are no more record.
 // Check Err() for errors.
@@ -183,15 +262,44 @@ func (r *Reader) ReadNextRecord() bool {
 		return false
 	}
 
-	_, r.err = UnmarshalRecord(r.Data, r.Record)
+	_, r.err = UnmarshalRecordMaxEntries(r.Data, r.Record, r.MaxEntries)
 	if r.err != nil {
 		return false
 	}
+	if r.RejectDuplicateKeys {
+		if key, ok := findDuplicateKey(r.Record.Entries); ok {
+			r.err = fmt.Errorf("duplicate key '%s' in record at position %d", key, r.CurrRecordPos)
+			return false
+		}
+	}
 	r.Record.Name = r.Name
 	r.Record.Timestamp = r.Timestamp
 	return true
 }
 
+// Records returns an iterator over key / value records.
+// The record is re-used i.e. it's only valid until the next
+// iteration. If reading fails, the last value is (nil, err).
+//
+//	for rec, err := range r.Records() {
+//		if err != nil {
+//			return err
+//		}
+//		v, ok := rec.Get("key")
+//	}
+func (r *Reader) Records() iter.Seq2[*ReadRecord, error] {
+	return func(yield func(*ReadRecord, error) bool) {
+		for r.ReadNextRecord() {
+			if !yield(r.Record, nil) {
+				return
+			}
+		}
+		if r.err != nil {
+			yield(nil, r.err)
+		}
+	}
+}
+
 // Err returns error from last Read. We swallow io.EOF to make it easier
 // to use
 func (r *Reader) Err() error {
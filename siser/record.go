@@ -2,9 +2,12 @@ package siser
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 /*
@@ -13,7 +16,8 @@ to serialize/parse and human-readable.
 
 The basic format is line-oriented: "key: value\n"
 
-When value is long (> 120 chars) or has \n in it, we serialize it as:
+When value is long (> 120 chars, see Record.LongFormatThreshold)
+or has \n in it, we serialize it as:
 key:+$len\n
 value\n
 */
@@ -32,6 +36,10 @@ type Record struct {
 	Name string
 	// when writing, if not provided we use current time
 	Timestamp time.Time
+	// values longer than this are written in long, size-prefixed
+	// format. If 0, we use defaultLongFormatThreshold (120).
+	// It only affects writing, any threshold can be read back
+	LongFormatThreshold int
 }
 
 type ReadRecord struct {
@@ -92,6 +100,49 @@ func (r *Record) WriteNonEmpty(args ...string) error {
 	return nil
 }
 
+// Merge adds key/value pairs from other to r. If a key already exists
+// in r, its value is replaced with the value from other (in place,
+// so the order of keys is preserved). Other keys are added at the end.
+// If other has a key more than once, the first value replaces the value
+// in r and the remaining values are added at the end, so no value
+// from other is lost.
+// Name and Timestamp of r are not changed.
+func (r *Record) Merge(other *Record) error {
+	rec, err := UnmarshalRecord(r.buf.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	otherRec, err := UnmarshalRecord(other.buf.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	entries := rec.Entries
+	// only match against entries r had before merging
+	nOrig := len(entries)
+	replacedKeys := map[string]bool{}
+	for _, e := range otherRec.Entries {
+		replaced := false
+		if !replacedKeys[e.Key] {
+			for i := 0; i < nOrig; i++ {
+				if entries[i].Key == e.Key {
+					entries[i].Value = e.Value
+					replaced = true
+				}
+			}
+		}
+		if replaced {
+			replacedKeys[e.Key] = true
+		} else {
+			entries = append(entries, e)
+		}
+	}
+	r.buf.Reset()
+	for _, e := range entries {
+		r.marshalKeyVal(e.Key, e.Value)
+	}
+	return nil
+}
+
 // Reset to re-use the record when writing for efficiency
 // it doesn't reset Name because common use case
 // is writing the same record type
@@ -120,26 +171,57 @@ func get(entries []Entry, key string) (string, bool) {
 	return "", false
 }
 
+// returns the first key that appears more than once
+func findDuplicateKey(entries []Entry) (string, bool) {
+	for i, e := range entries {
+		if _, ok := get(entries[:i], e.Key); ok {
+			return e.Key, true
+		}
+	}
+	return "", false
+}
+
 // Get returns a value for a given key
 func (r *ReadRecord) Get(key string) (string, bool) {
 	return get(r.Entries, key)
 }
 
+// Has returns true if record has a given key
+func (r *ReadRecord) Has(key string) bool {
+	_, ok := get(r.Entries, key)
+	return ok
+}
+
+// Keys returns all keys in the order they were written.
+// If a key was written more than once, it's returned more than once
+func (r *ReadRecord) Keys() []string {
+	res := make([]string, len(r.Entries))
+	for i, e := range r.Entries {
+		res[i] = e.Key
+	}
+	return res
+}
+
 func nonEmptyEndsWithNewline(s string) bool {
 	n := len(s)
 	return n == 0 || s[n-1] == '\n'
 }
 
+const defaultLongFormatThreshold = 120
+
 // return true if value needs to be serialized in long,
 // size-prefixed format
-func needsLongFormat(s string) bool {
-	return len(s) == 0 || len(s) > 120 || !serializableOnLine(s)
+func needsLongFormat(s string, threshold int) bool {
+	if threshold <= 0 {
+		threshold = defaultLongFormatThreshold
+	}
+	return len(s) == 0 || len(s) > threshold || !serializableOnLine(s)
 }
 
 func (r *Record) marshalKeyVal(key, val string) {
 	r.buf.WriteString(key)
 
-	isLong := needsLongFormat(val)
+	isLong := needsLongFormat(val, r.LongFormatThreshold)
 	if isLong {
 		r.buf.WriteString(":+")
 		slen := strconv.Itoa(len(val))
@@ -170,9 +252,20 @@ func (r *ReadRecord) Marshal() []byte {
 	return r.Record.Marshal()
 }
 
+// ErrTooManyEntries is returned when a record has more entries than allowed
+var ErrTooManyEntries = errors.New("siser: too many entries in record")
+
 // UnmarshalRecord unmarshall record as marshalled with Record.Marshal
 // For efficiency re-uses record r. If r is nil, will allocate new record.
 func UnmarshalRecord(d []byte, r *ReadRecord) (*ReadRecord, error) {
+	return UnmarshalRecordMaxEntries(d, r, 0)
+}
+
+// UnmarshalRecordMaxEntries is like UnmarshalRecord but returns
+// ErrTooManyEntries if record has more than maxEntries entries.
+// This bounds memory used for corrupt or malicious data.
+// maxEntries <= 0 means no limit
+func UnmarshalRecordMaxEntries(d []byte, r *ReadRecord, maxEntries int) (*ReadRecord, error) {
 	if r == nil {
 		r = &ReadRecord{}
 	} else {
@@ -189,6 +282,9 @@ func UnmarshalRecord(d []byte, r *ReadRecord) (*ReadRecord, error) {
 	}
 
 	for len(d) > 0 {
+		if maxEntries > 0 && len(r.Entries) >= maxEntries {
+			return nil, fmt.Errorf("%w (max %d)", ErrTooManyEntries, maxEntries)
+		}
 		idx := bytes.IndexByte(d, '\n')
 		if idx == -1 {
 			return nil, fmt.Errorf("missing '\n' marking end of header in '%s'", string(d))
@@ -237,6 +333,110 @@ func UnmarshalRecord(d []byte, r *ReadRecord) (*ReadRecord, error) {
 	return r, nil
 }
 
+// ValidateRecordBytes checks that d is a valid record as created by
+// Marshal, without allocating. It's stricter than UnmarshalRecord:
+// a long value must be followed by '\n' unless it's empty or already
+// ends with '\n', which catches most mismatched ":+${len}" prefixes.
+func ValidateRecordBytes(d []byte) error {
+	for len(d) > 0 {
+		idx := bytes.IndexByte(d, '\n')
+		if idx == -1 {
+			return fmt.Errorf("missing '\n' marking end of header in '%s'", string(d))
+		}
+		line := d[:idx]
+		d = d[idx+1:]
+		idx = bytes.IndexByte(line, ':')
+		if idx == -1 || idx+1 >= len(line) {
+			return fmt.Errorf("line in unrecognized format: '%s'", line)
+		}
+		kind := line[idx+1]
+		if kind == ' ' {
+			continue
+		}
+		if kind != '+' {
+			return fmt.Errorf("line in unrecognized format: '%s'", line)
+		}
+		val := line[idx+2:]
+		n, err := strconv.Atoi(string(val))
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("negative length %d of data", n)
+		}
+		if n > len(d) {
+			return fmt.Errorf("length of value %d greater than remaining data of size %d", n, len(d))
+		}
+		needsNewline := n > 0 && d[n-1] != '\n'
+		d = d[n:]
+		if needsNewline {
+			if len(d) == 0 || d[0] != '\n' {
+				return fmt.Errorf("missing '\n' after value of length %d in line '%s'", n, line)
+			}
+			d = d[1:]
+		}
+	}
+	return nil
+}
+
+// values longer than this are truncated in String()
+const maxStringValueLen = 64
+
+func formatRecord(name string, t time.Time, entries []Entry) string {
+	var sb strings.Builder
+	if name != "" || !t.IsZero() {
+		sb.WriteString("[")
+		sb.WriteString(name)
+		if !t.IsZero() {
+			if name != "" {
+				sb.WriteString(" ")
+			}
+			sb.WriteString("@ ")
+			sb.WriteString(t.UTC().Format("2006-01-02 15:04:05.000"))
+		}
+		sb.WriteString("]")
+	}
+	for _, e := range entries {
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		v := e.Value
+		if len(v) > maxStringValueLen {
+			// don't cut in the middle of utf8 sequence
+			n := maxStringValueLen
+			for n > 0 && !utf8.RuneStart(v[n]) {
+				n--
+			}
+			v = v[:n] + "..."
+		}
+		if v == "" || strings.ContainsAny(v, " =\"") || !serializableOnLine(v) {
+			v = strconv.Quote(v)
+		}
+		sb.WriteString(e.Key)
+		sb.WriteByte('=')
+		sb.WriteString(v)
+	}
+	return sb.String()
+}
+
+// String returns human-readable representation of the record,
+// for debugging, in format:
+// [${name} @ ${timestamp}] key1=val1 key2=val2
+// Long values are truncated
+func (r *Record) String() string {
+	var entries []Entry
+	if rec, err := UnmarshalRecord(r.buf.Bytes(), nil); err == nil {
+		entries = rec.Entries
+	}
+	return formatRecord(r.Name, r.Timestamp, entries)
+}
+
+// String returns human-readable representation of the record.
+// See Record.String
+func (r *ReadRecord) String() string {
+	return formatRecord(r.Name, r.Timestamp, r.Entries)
+}
+
 // Unmarshal resets record and decodes data as created by Marshal
 // into it.
 func (r *ReadRecord) Unmarshal(d []byte) error {
@@ -2,19 +2,35 @@ package siser
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"strconv"
 	"time"
 )
 
+// ErrBudgetExceeded is returned by a Writer with MaxBytes set
+// when a write would exceed the budget
+var ErrBudgetExceeded = errors.New("siser: write exceeds budget")
+
 // Writer writes records to in a structured format
 type Writer struct {
 	w io.Writer
 	// NoTimestamp disables writing timestamp, which
 	// makes serialized data not depend on when they were written
 	NoTimestamp bool
+	// MaxBytes, if > 0, is the maximum number of bytes this Writer
+	// will write. It doesn't include pos given in NewWriterAt.
+	// A write that would exceed it doesn't write anything
+	// and returns ErrBudgetExceeded
+	MaxBytes int64
 
 	writeBuf bytes.Buffer
+
+	// position in w of the next write
+	pos int64
+
+	// number of bytes written, for checking MaxBytes
+	written int64
 }
 
 // NewWriter creates a writer
@@ -24,6 +40,26 @@ func NewWriter(w io.Writer) *Writer {
 	}
 }
 
+// NewWriterAt creates a writer for w that already has pos bytes
+// e.g. a file opened for appending
+func NewWriterAt(w io.Writer, pos int64) *Writer {
+	return &Writer{
+		w:   w,
+		pos: pos,
+	}
+}
+
+// NewBudgetWriter creates a writer that writes at most maxBytes to w.
+// A write that would exceed the budget doesn't write anything
+// and returns ErrBudgetExceeded. maxBytes <= 0 means no limit.
+// To limit a writer created with NewWriterAt, set its MaxBytes
+func NewBudgetWriter(w io.Writer, maxBytes int64) *Writer {
+	return &Writer{
+		w:        w,
+		MaxBytes: maxBytes,
+	}
+}
+
 // WriteRecord writes a record in a specified format
 func (w *Writer) WriteRecord(r *Record) (int, error) {
 	d := r.Marshal()
@@ -32,6 +68,15 @@ func (w *Writer) WriteRecord(r *Record) (int, error) {
 	return n, err
 }
 
+// WriteRecordAt is like WriteRecord but also returns position
+// at which the record was written, which is useful for indexing
+// records. Position is relative to the position given in NewWriterAt
+func (w *Writer) WriteRecordAt(r *Record) (pos int64, n int, err error) {
+	pos = w.pos
+	n, err = w.WriteRecord(r)
+	return pos, n, err
+}
+
 // Write writes a block of data with optional timestamp and name.
 // Returns number of bytes written (length of d + lenght of metadata)
 // and an error
@@ -71,6 +116,11 @@ func (w *Writer) Write(d []byte, t time.Time, name string) (int, error) {
 	if needsNewline {
 		w.writeBuf.WriteByte('\n')
 	}
+	if w.MaxBytes > 0 && w.written+int64(w.writeBuf.Len()) > w.MaxBytes {
+		return 0, ErrBudgetExceeded
+	}
 	n2, err := w.writeBuf.WriteTo(w.w)
+	w.pos += n2
+	w.written += n2
 	return int(n2), err
 }
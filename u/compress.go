@@ -2,16 +2,20 @@ package u
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/andybalholm/brotli"
+	"github.com/kjk/common/atomicfile"
 	"github.com/klauspost/compress/zstd"
 )
 
@@ -69,6 +73,118 @@ func OpenFileMaybeCompressed(path string) (io.ReadCloser, error) {
 	return f, nil
 }
 
+type readerWithClose struct {
+	io.Reader
+	close func() error
+}
+
+func (rc *readerWithClose) Close() error {
+	return rc.close()
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+)
+
+// NewDecompressingReader returns a reader that decompresses r if it
+// starts with gzip or zstd or bzip2 header. Otherwise returns
+// data from r as is.
+// Brotli doesn't have a header so can't be detected.
+// If r is io.Closer, Close() also closes r.
+func NewDecompressingReader(r io.Reader) (io.ReadCloser, error) {
+	closeOrig := func() error {
+		if c, ok := r.(io.Closer); ok {
+			return c.Close()
+		}
+		return nil
+	}
+	br := bufio.NewReader(r)
+	// Peek returns io.EOF for data shorter than the magic
+	// which just means it's not compressed
+	hdr, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.HasPrefix(hdr, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		closeFn := func() error {
+			return GetErr(zr.Close(), closeOrig())
+		}
+		return &readerWithClose{zr, closeFn}, nil
+	}
+	if bytes.HasPrefix(hdr, zstdMagic) {
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		closeFn := func() error {
+			zr.Close()
+			return closeOrig()
+		}
+		return &readerWithClose{zr, closeFn}, nil
+	}
+	// "BZh" is followed by block size '1'...'9'
+	if bytes.HasPrefix(hdr, bzip2Magic) && len(hdr) > 3 && hdr[3] >= '1' && hdr[3] <= '9' {
+		return &readerWithClose{bzip2.NewReader(br), closeOrig}, nil
+	}
+	return &readerWithClose{br, closeOrig}, nil
+}
+
+// ErrUnsupportedEncoding is returned by DecompressResponseBody for
+// Content-Encoding it doesn't know how to decompress
+var ErrUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// DecompressResponseBody replaces resp.Body with a reader that decompresses
+// it based on Content-Encoding header (br, gzip, zstd).
+// Content-Encoding and Content-Length headers are removed, like
+// http.Transport does for transparently decompressed responses.
+// Closing the new resp.Body also closes the original body.
+// For unsupported encoding (e.g. deflate or "gzip, br") returns
+// ErrUnsupportedEncoding and leaves resp unchanged
+func DecompressResponseBody(resp *http.Response) error {
+	enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	body := resp.Body
+	var rc io.ReadCloser
+	switch enc {
+	case "", "identity":
+		return nil
+	case "br":
+		rc = &readerWithClose{brotli.NewReader(body), body.Close}
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		closeFn := func() error {
+			return GetErr(zr.Close(), body.Close())
+		}
+		rc = &readerWithClose{zr, closeFn}
+	case "zstd":
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			return err
+		}
+		closeFn := func() error {
+			zr.Close()
+			return body.Close()
+		}
+		rc = &readerWithClose{zr, closeFn}
+	default:
+		return fmt.Errorf("%w '%s'", ErrUnsupportedEncoding, enc)
+	}
+	resp.Body = rc
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
 // ReadFileMaybeCompressed reads file. Ungzips if it's gzipped.
 func ReadFileMaybeCompressed(path string) ([]byte, error) {
 	r, err := OpenFileMaybeCompressed(path)
@@ -282,34 +398,47 @@ func ReadZipData(zipData []byte) (map[string][]byte, error) {
 	return res, nil
 }
 
-// WriteFileGzipped writes data to a path, using best gzip compression
-func WriteFileGzipped(path string, data []byte) error {
-	f, err := os.Create(path)
+// compressToFileAtomically writes data from r compressed with a writer
+// from newWriter to dst. If it fails, dst is not created (or over-written)
+func compressToFileAtomically(dst string, r io.Reader, newWriter func(io.Writer) (io.WriteCloser, error)) error {
+	f, err := atomicfile.New(dst)
 	if err != nil {
 		return err
 	}
-	w, err := gzip.NewWriterLevel(f, gzip.BestCompression)
-	if err != nil {
+	defer f.RemoveIfNotClosed()
+	// temp file is 0600, we want the same mode as os.Create() so that
+	// e.g. pre-compressed assets can be read by a web server
+	if err = f.Chmod(0644); err != nil {
 		return err
 	}
-	_, err = w.Write(data)
+	w, err := newWriter(f)
 	if err != nil {
-		f.Close()
-		os.Remove(path)
 		return err
 	}
-	err = w.Close()
-	if err != nil {
-		f.Close()
-		os.Remove(path)
+	_, err = io.Copy(w, r)
+	err2 := w.Close()
+	if err = GetErr(err, err2); err != nil {
 		return err
 	}
-	err = f.Close()
+	return f.Close()
+}
+
+func compressFileAtomically(dst string, src string, newWriter func(io.Writer) (io.WriteCloser, error)) error {
+	fSrc, err := os.Open(src)
 	if err != nil {
-		os.Remove(path)
 		return err
 	}
-	return nil
+	defer fSrc.Close()
+	return compressToFileAtomically(dst, fSrc, newWriter)
+}
+
+func newGzipWriterBest(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gzip.BestCompression)
+}
+
+// WriteFileGzipped writes data to a path, using best gzip compression
+func WriteFileGzipped(path string, data []byte) error {
+	return compressToFileAtomically(path, bytes.NewReader(data), newGzipWriterBest)
 }
 
 func GzipCompressData(d []byte) ([]byte, error) {
@@ -337,25 +466,7 @@ func GzipDecompressData(d []byte) ([]byte, error) {
 }
 
 func GzipCompressFile(dstPath, srcPath string) error {
-	fSrc, err := os.Open(srcPath)
-	if err != nil {
-		return err
-	}
-	defer fSrc.Close()
-	fDst, err := os.Create(dstPath)
-	if err != nil {
-		return err
-	}
-	defer fDst.Close()
-	w, err := gzip.NewWriterLevel(fDst, gzip.BestCompression)
-	if err != nil {
-		return err
-	}
-	_, err = io.Copy(w, fSrc)
-	if err != nil {
-		return err
-	}
-	return w.Close()
+	return compressFileAtomically(dstPath, srcPath, newGzipWriterBest)
 }
 
 func GzipReadFile(path string) ([]byte, error) {
@@ -398,15 +509,10 @@ func BrDecompressData(d []byte) ([]byte, error) {
 }
 
 func BrCompressFile(dstPath string, path string, level int) error {
-	d, err := os.ReadFile(path)
-	if err != nil {
-		return err
-	}
-	d2, err := BrCompressData(d, level)
-	if err != nil {
-		return err
+	newWriter := func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriterLevel(w, level), nil
 	}
-	return os.WriteFile(dstPath, d2, 0644)
+	return compressFileAtomically(dstPath, path, newWriter)
 }
 
 func BrCompressFileDefault(dstPath string, path string) error {
@@ -476,29 +582,10 @@ func ZstdCompressFileDefault(dst string, src string) error {
 }
 
 func ZstdCompressFile(dst string, src string, level zstd.EncoderLevel) error {
-	fSrc, err := os.Open(src)
-	if err != nil {
-		return err
+	newWriter := func(w io.Writer) (io.WriteCloser, error) {
+		return zstdNewWriter(w, level)
 	}
-	defer fSrc.Close()
-	fDst, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	zw, err := zstdNewWriter(fDst, level)
-	if err != nil {
-		return err
-	}
-	_, err = io.Copy(zw, fSrc)
-	err2 := zw.Close()
-	err3 := fDst.Close()
-
-	err = GetErr(err, err2, err3)
-	if err != nil {
-		os.Remove(dst)
-		return err
-	}
-	return nil
+	return compressFileAtomically(dst, src, newWriter)
 }
 
 func ZstdReadFile(path string) ([]byte, error) {
@@ -1,7 +1,14 @@
 package u
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 
 	"github.com/kjk/common/assert"
@@ -93,3 +100,166 @@ func TestZstdFile(t *testing.T) {
 	testCompressDecompressFile(t, path, path+".zstd", ZstdCompressFileBest, ZstdReadFile)
 	testCompressDecompressFile(t, path, path+".zstd", ZstdCompressFileDefault, ZstdReadFile)
 }
+
+func testDecompressingReader(t *testing.T, compressed []byte, exp []byte) {
+	r, err := NewDecompressingReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+	d, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, exp, d)
+	assert.NoError(t, r.Close())
+}
+
+func TestDecompressingReader(t *testing.T) {
+	d := []byte("hello, world")
+	for len(d) < 1024*10 {
+		d = append(d, d...)
+	}
+	{
+		d2, err := GzipCompressData(d)
+		assert.NoError(t, err)
+		testDecompressingReader(t, d2, d)
+	}
+	{
+		d2, err := ZstdCompressDataDefault(d)
+		assert.NoError(t, err)
+		testDecompressingReader(t, d2, d)
+	}
+	{
+		// printf 'hello, bzip2' | bzip2 | base64
+		d2, err := base64.StdEncoding.DecodeString("QlpoOTFBWSZTWVNaisUAAAKZgEAEEAASZMAQIAAxANNNBAAeo29GUaIHi7kinChIKa1FYoA=")
+		assert.NoError(t, err)
+		testDecompressingReader(t, d2, []byte("hello, bzip2"))
+	}
+	// not compressed, including shorter than any header
+	testDecompressingReader(t, d, d)
+	testDecompressingReader(t, []byte("a"), []byte("a"))
+	testDecompressingReader(t, []byte{}, []byte{})
+	// starts like bzip2 but is missing block size digit
+	testDecompressingReader(t, []byte("BZhello"), []byte("BZhello"))
+	testDecompressingReader(t, []byte("BZh"), []byte("BZh"))
+}
+
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("read failed")
+	}
+	n := min(len(p), r.n, 1024)
+	for i := 0; i < n; i++ {
+		p[i] = 'a'
+	}
+	r.n -= n
+	return n, nil
+}
+
+func TestCompressToFileAtomically(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "out.gz")
+	err := os.WriteFile(dst, []byte("previous content"), 0644)
+	assert.NoError(t, err)
+
+	// fail in the middle of compression
+	r := &failingReader{n: 64 * 1024}
+	err = compressToFileAtomically(dst, r, newGzipWriterBest)
+	assert.Error(t, err)
+
+	// dst is not over-written and no temporary files are left
+	d, err := os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "previous content", string(d))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	err = WriteFileGzipped(dst, []byte("new content"))
+	assert.NoError(t, err)
+	d, err = GzipReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "new content", string(d))
+}
+
+func TestCompressFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on windows")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "index.html")
+	err := os.WriteFile(src, []byte("<html></html>"), 0644)
+	assert.NoError(t, err)
+
+	compressors := map[string]func(dst, src string) error{
+		"index.html.gz":  GzipCompressFile,
+		"index.html.br":  BrCompressFileDefault,
+		"index.html.zst": ZstdCompressFileDefault,
+	}
+	for name, compress := range compressors {
+		dst := filepath.Join(dir, name)
+		err = compress(dst, src)
+		assert.NoError(t, err)
+		fi, err := os.Stat(dst)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0644), fi.Mode().Perm(), "file: %s", name)
+	}
+}
+
+func TestDecompressResponseBody(t *testing.T) {
+	body := []byte("hello, compressed response body")
+	gzData, err := GzipCompressData(body)
+	assert.NoError(t, err)
+	brData, err := BrCompressDataDefault(body)
+	assert.NoError(t, err)
+	zstdData, err := ZstdCompressDataDefault(body)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		enc  string
+		data []byte
+	}{
+		{"", body},
+		{"identity", body},
+		{"gzip", gzData},
+		{"x-gzip", gzData},
+		{"br", brData},
+		{"zstd", zstdData},
+		{" ZSTD ", zstdData},
+	}
+	for _, tc := range tests {
+		resp := &http.Response{
+			Header:        http.Header{},
+			Body:          io.NopCloser(bytes.NewReader(tc.data)),
+			ContentLength: int64(len(tc.data)),
+		}
+		if tc.enc != "" {
+			resp.Header.Set("Content-Encoding", tc.enc)
+		}
+		err := DecompressResponseBody(resp)
+		assert.NoError(t, err)
+		d, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		assert.Equal(t, body, d, "enc: %s", tc.enc)
+		if tc.enc == "" || tc.enc == "identity" {
+			assert.False(t, resp.Uncompressed)
+		} else {
+			assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+			assert.True(t, resp.Uncompressed)
+			assert.Equal(t, int64(-1), resp.ContentLength)
+		}
+	}
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": {"deflate"}},
+		Body:   io.NopCloser(bytes.NewReader(body)),
+	}
+	err = DecompressResponseBody(resp)
+	assert.True(t, errors.Is(err, ErrUnsupportedEncoding))
+	// resp is not changed
+	assert.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	d, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, d)
+}
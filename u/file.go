@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"bufio"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -215,6 +216,78 @@ func IterReadDirFS(fsys fs.ReadDirFS, startDir string, cb func(string, fs.DirEnt
 	return nil
 }
 
+// DirSize returns total size of all regular files in dir, recursively
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := IterDir(dir, func(path string, de fs.DirEntry) (bool, error) {
+		if !de.Type().IsRegular() {
+			return false, nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return false, err
+		}
+		size += fi.Size()
+		return false, nil
+	})
+	return size, err
+}
+
+// DirFileCount returns number of regular files in dir, recursively
+func DirFileCount(dir string) (int, error) {
+	n := 0
+	err := IterDir(dir, func(path string, de fs.DirEntry) (bool, error) {
+		if de.Type().IsRegular() {
+			n++
+		}
+		return false, nil
+	})
+	return n, err
+}
+
+// AppendToFileLocked appends data to a file, creating it if necessary.
+// It holds an exclusive advisory lock on the file while writing so it's
+// safe to call from multiple processes.
+// Locking is supported on unix (flock) and windows (LockFileEx).
+// On other platforms it only relies on O_APPEND.
+func AppendToFileLocked(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = f.Write(data)
+	err2 := unlockFile(f)
+	err3 := f.Close()
+	return GetErr(err, err2, err3)
+}
+
+// CreateExclusive creates a file with data only if it doesn't already exist.
+// Returns created=false and no error if path already exists.
+// Creation is atomic (O_EXCL) so it can be used as a simple guard
+// between processes e.g. for lock files or initialization markers.
+// If writing data fails, the file is removed
+func CreateExclusive(path string, data []byte, perm os.FileMode) (created bool, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	_, err = f.Write(data)
+	err = GetErr(err, f.Close())
+	if err != nil {
+		os.Remove(path)
+		return false, err
+	}
+	return true, nil
+}
+
 type syncer interface {
 	Sync() error
 }
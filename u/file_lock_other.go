@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package u
+
+import "os"
+
+// no advisory locking on this platform, we only rely on O_APPEND
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
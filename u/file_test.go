@@ -0,0 +1,92 @@
+package u
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kjk/common/assert"
+)
+
+func TestDirSize(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.txt":         "hello",
+		"sub/b.txt":     "world!",
+		"sub/sub2/c.md": "",
+	}
+	for name, s := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		assert.NoError(t, err)
+		err = os.WriteFile(path, []byte(s), 0644)
+		assert.NoError(t, err)
+	}
+	size, err := DirSize(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), size)
+
+	n, err := DirFileCount(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	_, err = DirSize(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestAppendToFileLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.txt")
+	nWriters := 8
+	nLines := 50
+	// long lines make interleaved writes more likely
+	pad := strings.Repeat("x", 4096)
+	var wg sync.WaitGroup
+	for i := 0; i < nWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < nLines; j++ {
+				line := fmt.Sprintf("%d %d %s\n", i, j, pad)
+				err := AppendToFileLocked(path, []byte(line))
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lines, err := ReadLines(path)
+	assert.NoError(t, err)
+	assert.Equal(t, nWriters*nLines, len(lines))
+	seen := map[string]bool{}
+	for _, line := range lines {
+		parts := strings.Split(line, " ")
+		assert.Equal(t, 3, len(parts))
+		assert.Equal(t, pad, parts[2])
+		seen[parts[0]+" "+parts[1]] = true
+	}
+	assert.Equal(t, nWriters*nLines, len(seen))
+}
+
+func TestCreateExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "init.lock")
+	created, err := CreateExclusive(path, []byte("first"), 0644)
+	assert.NoError(t, err)
+	assert.True(t, created)
+
+	created, err = CreateExclusive(path, []byte("second"), 0644)
+	assert.NoError(t, err)
+	assert.False(t, created)
+
+	d, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(d))
+
+	// directory doesn't exist
+	path = filepath.Join(t.TempDir(), "missing", "init.lock")
+	created, err = CreateExclusive(path, nil, 0644)
+	assert.Error(t, err)
+	assert.False(t, created)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math/rand"
 	"mime"
 	"os"
 	"os/exec"
@@ -229,3 +230,114 @@ func WaitForSigIntOrKill() {
 	defer stop()
 	<-sctx.Done()
 }
+
+// RunUntilSignal waits for SIGINT or SIGTERM and calls onShutdown
+// with a context that expires after gracePeriod.
+// If onShutdown doesn't finish within gracePeriod, returns an error
+// without waiting for it, so that the caller can exit.
+func RunUntilSignal(onShutdown func(ctx context.Context) error, gracePeriod time.Duration) error {
+	// Ctrl-C sends SIGINT
+	sctx, stop := signal.NotifyContext(context.Background(), os.Interrupt /*SIGINT*/, syscall.SIGTERM)
+	defer stop()
+	return runUntilDone(sctx, onShutdown, gracePeriod)
+}
+
+func runUntilDone(sctx context.Context, onShutdown func(ctx context.Context) error, gracePeriod time.Duration) error {
+	<-sctx.Done()
+	if onShutdown == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- onShutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("shutdown didn't finish in %s: %w", gracePeriod, ctx.Err())
+	}
+}
+
+// IsSystemdAvailable returns true if the system was booted with systemd
+// (same check as sd_booted())
+func IsSystemdAvailable() bool {
+	return isSystemdAvailable("/")
+}
+
+func isSystemdAvailable(root string) bool {
+	return DirExists(filepath.Join(root, "run", "systemd", "system"))
+}
+
+// IsInContainer returns true if we're running inside a container
+// (docker, podman, kubernetes, lxc). It's a best-effort guess
+func IsInContainer() bool {
+	return isInContainer("/")
+}
+
+func isInContainer(root string) bool {
+	if FileExists(filepath.Join(root, ".dockerenv")) {
+		return true
+	}
+	// podman
+	if FileExists(filepath.Join(root, "run", ".containerenv")) {
+		return true
+	}
+	d, err := os.ReadFile(filepath.Join(root, "proc", "1", "cgroup"))
+	if err != nil {
+		return false
+	}
+	s := string(d)
+	for _, name := range []string{"docker", "kubepods", "containerd", "lxc"} {
+		if strings.Contains(s, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry calls fn up to attempts times until it succeeds.
+// fn is always called at least once, even if attempts < 1.
+// Between attempts it waits backoff, doubled after each attempt,
+// with random jitter (between 50% and 100% of the wait).
+// If shouldRetry is not nil and returns false for an error, we give up
+// immediately. Returns the last error from fn
+func Retry(attempts int, backoff time.Duration, fn func() error, shouldRetry func(error) bool) error {
+	return RetryCtx(context.Background(), attempts, backoff, fn, shouldRetry)
+}
+
+// RetryCtx is like Retry but stops waiting between attempts when ctx
+// is cancelled. In that case returns ctx.Err()
+func RetryCtx(ctx context.Context, attempts int, backoff time.Duration, fn func() error, shouldRetry func(error) bool) error {
+	attempts = max(attempts, 1)
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			wait := backoff
+			if wait > 1 {
+				wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)))
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+			// don't double forever so that we don't overflow
+			if backoff < time.Hour {
+				backoff *= 2
+			}
+		}
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if shouldRetry != nil && !shouldRetry(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -1,7 +1,12 @@
 package u
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/kjk/common/assert"
 )
@@ -39,3 +44,140 @@ func TestSlugNoLowerCase(t *testing.T) {
 		assert.Equal(t, tests[i+1], got)
 	}
 }
+
+func TestRunUntilDone(t *testing.T) {
+	{
+		sctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		called := false
+		err := runUntilDone(sctx, func(ctx context.Context) error {
+			_, hasDeadline := ctx.Deadline()
+			assert.True(t, hasDeadline)
+			called = true
+			return nil
+		}, time.Second)
+		assert.NoError(t, err)
+		assert.True(t, called)
+	}
+	{
+		sctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		errShutdown := errors.New("shutdown failed")
+		err := runUntilDone(sctx, func(ctx context.Context) error {
+			return errShutdown
+		}, time.Second)
+		assert.True(t, errors.Is(err, errShutdown))
+	}
+	{
+		// onShutdown takes longer than grace period
+		sctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		block := make(chan bool)
+		defer close(block)
+		err := runUntilDone(sctx, func(ctx context.Context) error {
+			<-block
+			return nil
+		}, time.Millisecond*10)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	}
+}
+
+func TestIsInContainer(t *testing.T) {
+	// only checks it doesn't crash, the answer depends on the environment
+	t.Logf("IsInContainer: %v, IsSystemdAvailable: %v", IsInContainer(), IsSystemdAvailable())
+
+	writeFile := func(root string, path string, s string) {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		assert.NoError(t, err)
+		err = os.WriteFile(path, []byte(s), 0644)
+		assert.NoError(t, err)
+	}
+
+	root := t.TempDir()
+	assert.False(t, isInContainer(root))
+	assert.False(t, isSystemdAvailable(root))
+	writeFile(root, "proc/1/cgroup", "0::/init.scope\n")
+	assert.False(t, isInContainer(root))
+	writeFile(root, "proc/1/cgroup", "12:pids:/docker/0123abcd\n")
+	assert.True(t, isInContainer(root))
+
+	root = t.TempDir()
+	writeFile(root, ".dockerenv", "")
+	assert.True(t, isInContainer(root))
+
+	root = t.TempDir()
+	writeFile(root, "run/.containerenv", "")
+	assert.True(t, isInContainer(root))
+
+	root = t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "run", "systemd", "system"), 0755)
+	assert.NoError(t, err)
+	assert.True(t, isSystemdAvailable(root))
+}
+
+func TestRetry(t *testing.T) {
+	errTemp := errors.New("temporary")
+	errFatal := errors.New("fatal")
+
+	// succeeds after failures
+	n := 0
+	err := Retry(5, time.Millisecond, func() error {
+		n++
+		if n < 3 {
+			return errTemp
+		}
+		return nil
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// gives up after attempts, returns last error
+	n = 0
+	err = Retry(3, time.Millisecond, func() error {
+		n++
+		return errTemp
+	}, nil)
+	assert.Equal(t, errTemp, err)
+	assert.Equal(t, 3, n)
+
+	// doesn't retry errors rejected by shouldRetry
+	n = 0
+	shouldRetry := func(err error) bool {
+		return !errors.Is(err, errFatal)
+	}
+	err = Retry(5, time.Millisecond, func() error {
+		n++
+		if n == 2 {
+			return errFatal
+		}
+		return errTemp
+	}, shouldRetry)
+	assert.Equal(t, errFatal, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestRetryNoAttempts(t *testing.T) {
+	errFail := errors.New("fail")
+	for _, attempts := range []int{0, -1} {
+		n := 0
+		err := Retry(attempts, time.Millisecond, func() error {
+			n++
+			return errFail
+		}, nil)
+		assert.Equal(t, errFail, err)
+		assert.Equal(t, 1, n)
+	}
+}
+
+func TestRetryCtx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	err := RetryCtx(ctx, 10, time.Hour, func() error {
+		n++
+		cancel()
+		return errors.New("fail")
+	}, nil)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, 1, n)
+}
@@ -1,6 +1,8 @@
 package u
 
 import (
+	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -146,14 +148,32 @@ func ExpandTildeInPath(s string) string {
 	return s
 }
 
+// JoinURLPath joins base and url-escaped segments with a single "/"
+// e.g. JoinURLPath("https://x.com/", "a b", "ż") => "https://x.com/a%20b/%C5%BC"
+// base is not escaped. Leading and trailing "/" in segments are
+// removed and empty segments are skipped.
+func JoinURLPath(base string, segments ...string) string {
+	res := strings.TrimSuffix(base, "/")
+	for _, seg := range segments {
+		seg = strings.Trim(seg, "/")
+		if seg == "" {
+			continue
+		}
+		res += "/" + url.PathEscape(seg)
+	}
+	return res
+}
+
 func ParseEnvMust(d []byte) map[string]string {
 	d = NormalizeNewlines(d)
 	s := string(d)
 	lines := strings.Split(s, "\n")
 	m := make(map[string]string)
 	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
+		// only trim left side, trailing whitespace is part of
+		// a multi-line quoted value
+		line = strings.TrimLeft(line, " \t")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 		parts := strings.SplitN(line, "=", 2)
@@ -164,3 +184,100 @@ func ParseEnvMust(d []byte) map[string]string {
 	}
 	return m
 }
+
+// ParseDotEnv parses content of .env file. Supports:
+// - comments (lines starting with '#' and " #" after unquoted values)
+// - optional "export " prefix
+// - single-quoted values (taken literally)
+// - double-quoted values with \n, \", \\ escapes
+// Quoted values can span multiple lines.
+func ParseDotEnv(d []byte) (map[string]string, error) {
+	s := string(NormalizeNewlines(d))
+	m := map[string]string{}
+	lineNo := 0
+	for len(s) > 0 {
+		lineNo++
+		var line string
+		idx := strings.IndexByte(s, '\n')
+		if idx == -1 {
+			line, s = s, ""
+		} else {
+			line, s = s[:idx], s[idx+1:]
+		}
+		// only trim left side, trailing whitespace is part of
+		// a multi-line quoted value
+		line = strings.TrimLeft(line, " \t")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		idx = strings.IndexByte(line, '=')
+		if idx == -1 {
+			return nil, fmt.Errorf("line %d: missing '=' in '%s'", lineNo, line)
+		}
+		key := strings.TrimSpace(line[:idx])
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: invalid key '%s'", lineNo, key)
+		}
+		val := strings.TrimLeft(line[idx+1:], " \t")
+		if val == "" || (val[0] != '"' && val[0] != '\'') {
+			// unquoted value, can have a comment at the end
+			val = strings.TrimSpace(val)
+			if idx = strings.Index(val, " #"); idx >= 0 {
+				val = strings.TrimSpace(val[:idx])
+			}
+			m[key] = val
+			continue
+		}
+
+		// quoted value, possibly spanning multiple lines
+		startLineNo := lineNo
+		quote := val[0]
+		rest := val[1:]
+		var sb strings.Builder
+		for {
+			end := -1
+			for i := 0; i < len(rest); i++ {
+				c := rest[i]
+				if c == quote {
+					end = i
+					break
+				}
+				if quote == '"' && c == '\\' && i+1 < len(rest) {
+					i++
+					switch rest[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(rest[i])
+					}
+					continue
+				}
+				sb.WriteByte(c)
+			}
+			if end >= 0 {
+				rest = strings.TrimSpace(rest[end+1:])
+				break
+			}
+			if s == "" {
+				return nil, fmt.Errorf("line %d: missing closing %c for value of '%s'", startLineNo, quote, key)
+			}
+			// value continues on the next line
+			sb.WriteByte('\n')
+			lineNo++
+			idx = strings.IndexByte(s, '\n')
+			if idx == -1 {
+				rest, s = s, ""
+			} else {
+				rest, s = s[:idx], s[idx+1:]
+			}
+		}
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("line %d: unexpected '%s' after quoted value of '%s'", lineNo, rest, key)
+		}
+		m[key] = sb.String()
+	}
+	return m, nil
+}
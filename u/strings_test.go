@@ -38,6 +38,75 @@ func TestTrimExt(t *testing.T) {
 	}
 }
 
+func TestJoinURLPath(t *testing.T) {
+	tests := []struct {
+		base     string
+		segments []string
+		exp      string
+	}{
+		{"https://x.com", []string{"foo", "bar.txt"}, "https://x.com/foo/bar.txt"},
+		{"https://x.com/", []string{"/foo/", "/bar"}, "https://x.com/foo/bar"},
+		{"https://x.com/dir", []string{"a b", "c?d#e"}, "https://x.com/dir/a%20b/c%3Fd%23e"},
+		{"/files", []string{"zażółć", "", "x"}, "/files/za%C5%BC%C3%B3%C5%82%C4%87/x"},
+		{"", []string{"a/b"}, "/a%2Fb"},
+	}
+	for _, test := range tests {
+		got := JoinURLPath(test.base, test.segments...)
+		assert.Equal(t, test.exp, got)
+	}
+}
+
+func TestParseDotEnv(t *testing.T) {
+	s := `# comment
+export FOO=bar
+EMPTY=
+SPACED = some value # trailing comment
+HASH=a#b
+SINGLE='literal \n "x"'
+DOUBLE="say \"hi\"\tthere\n"
+MULTI="line 1
+line 2
+  # not a comment"
+MULTI_SINGLE='a
+b' # comment
+
+URL=https://example.com/?a=b
+`
+	// whitespace at the end of lines, easy to lose in the source
+	s += "TRAIL=\"a   \nb\"\n"
+	s += "UNQUOTED=x   \n"
+	s += "QUOTED = \"  y  \"  \n"
+	m, err := ParseDotEnv([]byte(s))
+	assert.NoError(t, err)
+	exp := map[string]string{
+		"FOO":          "bar",
+		"EMPTY":        "",
+		"SPACED":       "some value",
+		"HASH":         "a#b",
+		"SINGLE":       `literal \n "x"`,
+		"DOUBLE":       "say \"hi\"\tthere\n",
+		"MULTI":        "line 1\nline 2\n  # not a comment",
+		"MULTI_SINGLE": "a\nb",
+		"URL":          "https://example.com/?a=b",
+		"TRAIL":        "a   \nb",
+		"UNQUOTED":     "x",
+		"QUOTED":       "  y  ",
+	}
+	assert.Equal(t, exp, m)
+
+	invalid := []string{
+		"FOO",
+		"=bar",
+		"FOO BAR=x",
+		"FOO=\"unterminated\nBAR=x\n",
+		"FOO='a' b",
+	}
+	for _, s := range invalid {
+		_, err := ParseDotEnv([]byte(s))
+		assert.Error(t, err, "s: '%s'", s)
+	}
+}
+
 func TestCapitalize(t *testing.T) {
 	tests := []struct {
 		s   string